@@ -0,0 +1,210 @@
+// Copyright 2021 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package form2json
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+func init() {
+	caddy.RegisterModule(App{})
+}
+
+// App owns state which is shared between form2json handlers, across
+// routes and servers: named keys, sinks and worker pools. Handlers
+// refer to them by name. The app is loaded automatically when a
+// handler refers to it, if it is not configured.
+type App struct {
+	// Named secret keys. Handlers can refer to them in their config
+	// with the {form2json.keys.NAME} placeholder, so that secrets are
+	// configured once. Values may themselves contain placeholders,
+	// e.g. {env.FORM2JSON_KEY}.
+	Keys map[string]string `json:"keys,omitempty"`
+
+	// Named sinks to which converted payloads can be delivered.
+	SinksRaw map[string]json.RawMessage `json:"sinks,omitempty" caddy:"namespace=form2json.sinks inline_key=sink"`
+
+	// Named worker pools, which limit work such as file processing
+	// across all handlers using them.
+	Pools map[string]*Pool `json:"pools,omitempty"`
+
+	sinks map[string]Sink
+}
+
+// CaddyModule returns the Caddy module information.
+func (App) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "form2json",
+		New: func() caddy.Module { return new(App) },
+	}
+}
+
+// Provision sets up the app.
+func (a *App) Provision(ctx caddy.Context) error {
+	repl := caddy.NewReplacer()
+	for name, key := range a.Keys {
+		a.Keys[name] = repl.ReplaceAll(key, "")
+	}
+
+	a.sinks = make(map[string]Sink)
+	if a.SinksRaw != nil {
+		mods, err := ctx.LoadModule(a, "SinksRaw")
+		if err != nil {
+			return fmt.Errorf("loading sinks: %v", err)
+		}
+		for name, mod := range mods.(map[string]interface{}) {
+			sink, ok := mod.(Sink)
+			if !ok {
+				return fmt.Errorf("sink %s: module is not a sink", name)
+			}
+			a.sinks[name] = sink
+		}
+	}
+
+	for name, pool := range a.Pools {
+		if pool.Size <= 0 {
+			return fmt.Errorf("pool %s: size must be positive", name)
+		}
+		pool.sem = make(chan struct{}, pool.Size)
+	}
+	return nil
+}
+
+// Start starts the sinks which need to be started, such as those which
+// hold connections.
+func (a *App) Start() error {
+	var started []caddy.App
+	for _, mod := range a.lifecycleModules() {
+		if err := mod.Start(); err != nil {
+			for _, s := range started {
+				s.Stop()
+			}
+			return err
+		}
+		started = append(started, mod)
+	}
+	return nil
+}
+
+// Stop stops the sinks started by Start.
+func (a *App) Stop() error {
+	var firstErr error
+	for _, mod := range a.lifecycleModules() {
+		if err := mod.Stop(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// lifecycleModules returns the sinks which need to be started and
+// stopped with the app.
+func (a *App) lifecycleModules() []caddy.App {
+	var mods []caddy.App
+	for _, sink := range a.sinks {
+		if mod, ok := sink.(caddy.App); ok {
+			mods = append(mods, mod)
+		}
+	}
+	return mods
+}
+
+// sink returns the named sink.
+func (a *App) sink(name string) (Sink, error) {
+	sink, ok := a.sinks[name]
+	if !ok {
+		return nil, fmt.Errorf("no sink named %q", name)
+	}
+	return sink, nil
+}
+
+// pool returns the named worker pool.
+func (a *App) pool(name string) (*Pool, error) {
+	pool, ok := a.Pools[name]
+	if !ok {
+		return nil, fmt.Errorf("no pool named %q", name)
+	}
+	return pool, nil
+}
+
+// replaceKey resolves {form2json.keys.NAME} placeholders.
+func (a *App) replaceKey(key string) (interface{}, bool) {
+	if !strings.HasPrefix(key, keyPlaceholderPrefix) {
+		return nil, false
+	}
+	value, ok := a.Keys[strings.TrimPrefix(key, keyPlaceholderPrefix)]
+	return value, ok
+}
+
+// Pool limits the number of concurrent jobs of a kind.
+type Pool struct {
+	// The maximum number of concurrent jobs.
+	Size int `json:"size"`
+
+	sem chan struct{}
+}
+
+// acquire blocks until a job may run, or ctx is done. Each successful
+// call must be followed by a call to release.
+func (p *Pool) acquire(ctx context.Context) error {
+	select {
+	case p.sem <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// release ends a job started with acquire.
+func (p *Pool) release() {
+	<-p.sem
+}
+
+// Sink is a destination for converted payloads, such as a message
+// queue. Sinks are modules in the form2json.sinks namespace; sinks
+// which implement caddy.App are started and stopped with the app.
+// Publish returns a caddyhttp.HandlerError for messages which cannot
+// be published at all, such as those templated to an invalid
+// destination; such publishes are not retried.
+type Sink interface {
+	Publish(ctx context.Context, msg Message) error
+}
+
+// Message is a converted payload delivered to a sink.
+type Message struct {
+	// The submission ID of the payload, which sinks record as the
+	// message ID where their protocol has one.
+	ID string
+
+	// Headers describing the payload, such as Content-Type.
+	Header http.Header
+
+	// The converted payload.
+	Body []byte
+}
+
+const keyPlaceholderPrefix = "form2json.keys."
+
+// Interface guards
+var (
+	_ caddy.App         = (*App)(nil)
+	_ caddy.Provisioner = (*App)(nil)
+)
@@ -0,0 +1,375 @@
+// Copyright 2021 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package form2json
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+)
+
+// Archive appends every converted payload to a tamper-evident archive
+// file before the request is passed on. The archive is a file of JSON
+// lines, each of which holds the SHA-256 of the line before it, so
+// that altering, removing or reordering any line breaks the chain.
+// The chain is periodically sealed with a line carrying an Ed25519
+// signature of its head, so that it cannot be rewritten from the
+// start without the signing key. Archives are checked with the
+// "caddy form2json-verify" command.
+//
+// If the last line of the archive is incomplete, because the process
+// crashed while writing it, the line is removed when the archive is
+// opened, and a warning is logged. Records are synced to disk before
+// the request is passed on, so its submission was never accepted.
+//
+// Record lines have the type "record" and carry the submission ID,
+// Content-Type, Content-Type-Class and base64-encoded payload; seal
+// lines have the type "seal". All lines carry a sequence number, the
+// time they were written, and the hex-encoded hash of the previous
+// line ("prev"); the first line's previous hash is all zeros.
+type Archive struct {
+	// The path of the archive file, which is created if it does not
+	// exist. Handlers using the same path share the archive.
+	Path string `json:"path"`
+
+	// The base64-encoded Ed25519 private key (or its 32-byte seed)
+	// with which seals are signed. Placeholders are supported, e.g.
+	// {env.ARCHIVE_KEY} or {form2json.keys.archive}.
+	SigningKey string `json:"signing_key"`
+
+	// The number of records after which the archive is sealed.
+	// Default: 100
+	SealEvery int `json:"seal_every,omitempty"`
+
+	// The maximum time records remain unsealed. Default: 1m
+	SealInterval caddy.Duration `json:"seal_interval,omitempty"`
+
+	key    ed25519.PrivateKey
+	writer *archiveWriter
+}
+
+func (a *Archive) provision(repl *caddy.Replacer, logger *zap.Logger) error {
+	if a.Path == "" {
+		return fmt.Errorf("path is required")
+	}
+	if a.SealEvery <= 0 {
+		a.SealEvery = defaultSealEvery
+	}
+	if a.SealInterval <= 0 {
+		a.SealInterval = caddy.Duration(defaultSealInterval)
+	}
+
+	key, err := base64.StdEncoding.DecodeString(repl.ReplaceAll(a.SigningKey, ""))
+	if err != nil {
+		return fmt.Errorf("decoding signing key: %v", err)
+	}
+	switch len(key) {
+	case ed25519.SeedSize:
+		a.key = ed25519.NewKeyFromSeed(key)
+	case ed25519.PrivateKeySize:
+		a.key = ed25519.PrivateKey(key)
+	default:
+		return fmt.Errorf("signing key must be an Ed25519 private key or seed")
+	}
+
+	a.Path, err = filepath.Abs(a.Path)
+	if err != nil {
+		return err
+	}
+	val, _, err := archiveWriters.LoadOrNew(a.Path, func() (caddy.Destructor, error) {
+		return openArchive(a.Path, logger)
+	})
+	if err != nil {
+		return err
+	}
+	a.writer = val.(*archiveWriter)
+
+	// the most recently loaded config determines how the archive is
+	// sealed from now on
+	a.writer.configure(a.key, a.SealEvery, time.Duration(a.SealInterval))
+	return nil
+}
+
+func (a *Archive) cleanup() error {
+	if a.writer == nil {
+		return nil
+	}
+	_, err := archiveWriters.Delete(a.Path)
+	return err
+}
+
+// append archives a converted payload.
+func (a *Archive) append(id, contentType, class string, payload []byte) error {
+	err := a.writer.append(archiveEntry{
+		Type:         archiveRecord,
+		SubmissionID: id,
+		ContentType:  contentType,
+		Class:        class,
+		Payload:      payload,
+	})
+	if err != nil {
+		return caddyhttp.Error(http.StatusInternalServerError, fmt.Errorf("archiving submission: %v", err))
+	}
+	return nil
+}
+
+// archiveEntry is a line of an archive.
+type archiveEntry struct {
+	Type         string `json:"type"`
+	Seq          uint64 `json:"seq"`
+	Time         string `json:"time"`
+	Prev         string `json:"prev"`
+	SubmissionID string `json:"submission_id,omitempty"`
+	ContentType  string `json:"content_type,omitempty"`
+	Class        string `json:"class,omitempty"`
+	Payload      []byte `json:"payload,omitempty"`
+	Signature    []byte `json:"signature,omitempty"`
+}
+
+// sealMessage returns the message signed by the seal with the given
+// sequence number and previous hash.
+func sealMessage(seq uint64, prev string) []byte {
+	return []byte("form2json-archive-seal:" + strconv.FormatUint(seq, 10) + ":" + prev)
+}
+
+// archiveWriter appends to an archive file. It is shared by all
+// handlers using the file, including across config reloads.
+type archiveWriter struct {
+	mu        sync.Mutex
+	f         *os.File
+	seq       uint64   // sequence number of the next line
+	prev      [32]byte // hash of the last line
+	unsealed  int      // records written since the last seal
+	key       ed25519.PrivateKey
+	sealEvery int
+	interval  time.Duration
+	kick      chan struct{} // reschedules the seal timer
+	done      chan struct{}
+}
+
+// openArchive opens the archive at path for appending, reading it to
+// find the head of its chain. An incomplete last line is truncated.
+func openArchive(path string, logger *zap.Logger) (*archiveWriter, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	aw := &archiveWriter{
+		f:    f,
+		kick: make(chan struct{}, 1),
+		done: make(chan struct{}),
+	}
+	size, err := scanArchive(f, func(line []byte, hash [32]byte) error {
+		aw.seq++
+		aw.prev = hash
+		if bytes.HasPrefix(line, []byte(`{"type":"`+archiveSeal+`"`)) {
+			aw.unsealed = 0
+		} else {
+			aw.unsealed++
+		}
+		return nil
+	})
+	if err == errIncompleteLine {
+		err = truncateArchive(f, size, logger)
+	}
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("reading archive %s: %v", path, err)
+	}
+	go aw.sealPeriodically()
+	return aw, nil
+}
+
+// truncateArchive removes the incomplete last line of the archive f,
+// which holds size bytes of complete lines.
+func truncateArchive(f *os.File, size int64, logger *zap.Logger) error {
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if err := f.Truncate(size); err != nil {
+		return err
+	}
+	logger.Warn("removed incomplete last line of archive",
+		zap.String("path", f.Name()),
+		zap.Int64("offset", size),
+		zap.Int64("bytes", info.Size()-size))
+	return nil
+}
+
+func (aw *archiveWriter) configure(key ed25519.PrivateKey, sealEvery int, interval time.Duration) {
+	aw.mu.Lock()
+	aw.key = key
+	aw.sealEvery = sealEvery
+	aw.interval = interval
+	aw.mu.Unlock()
+	select {
+	case aw.kick <- struct{}{}:
+	default:
+	}
+}
+
+// append writes e as the next line of the archive, and seals the
+// archive if enough records have been written. The file is synced
+// before append returns, so that accepted records survive a crash.
+func (aw *archiveWriter) append(e archiveEntry) error {
+	aw.mu.Lock()
+	defer aw.mu.Unlock()
+	if err := aw.writeLocked(e); err != nil {
+		return err
+	}
+	aw.unsealed++
+	if aw.unsealed >= aw.sealEvery {
+		return aw.sealLocked()
+	}
+	return aw.f.Sync()
+}
+
+// sealLocked writes a seal line, if there are unsealed records, and
+// syncs the file.
+func (aw *archiveWriter) sealLocked() error {
+	if aw.unsealed == 0 {
+		return nil
+	}
+	prev := hex.EncodeToString(aw.prev[:])
+	err := aw.writeLocked(archiveEntry{
+		Type:      archiveSeal,
+		Signature: ed25519.Sign(aw.key, sealMessage(aw.seq, prev)),
+	})
+	if err != nil {
+		return err
+	}
+	aw.unsealed = 0
+	return aw.f.Sync()
+}
+
+// writeLocked completes e with its position in the chain and writes it.
+func (aw *archiveWriter) writeLocked(e archiveEntry) error {
+	if aw.f == nil {
+		return fmt.Errorf("archive is closed")
+	}
+	e.Seq = aw.seq
+	e.Time = time.Now().UTC().Format(time.RFC3339Nano)
+	e.Prev = hex.EncodeToString(aw.prev[:])
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	if _, err := aw.f.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	aw.seq++
+	aw.prev = sha256.Sum256(line)
+	return nil
+}
+
+// sealPeriodically seals the archive at the configured interval until
+// it is closed.
+func (aw *archiveWriter) sealPeriodically() {
+	for {
+		aw.mu.Lock()
+		interval := aw.interval
+		aw.mu.Unlock()
+		if interval <= 0 {
+			interval = defaultSealInterval
+		}
+		timer := time.NewTimer(interval)
+		select {
+		case <-aw.done:
+			timer.Stop()
+			return
+		case <-aw.kick:
+			timer.Stop()
+		case <-timer.C:
+			aw.mu.Lock()
+			aw.sealLocked()
+			aw.mu.Unlock()
+		}
+	}
+}
+
+// Destruct seals and closes the archive once it is no longer used.
+func (aw *archiveWriter) Destruct() error {
+	close(aw.done)
+	aw.mu.Lock()
+	defer aw.mu.Unlock()
+	err := aw.sealLocked()
+	if cerr := aw.f.Close(); err == nil {
+		err = cerr
+	}
+	aw.f = nil
+	return err
+}
+
+// scanArchive calls fn with each line of the archive read from r, not
+// including its line ending, and the SHA-256 of the line. It returns
+// the size of the lines read, and errIncompleteLine if the archive
+// ends with an incomplete line.
+func scanArchive(r io.Reader, fn func(line []byte, hash [32]byte) error) (int64, error) {
+	br := bufio.NewReader(r)
+	var size int64
+	for {
+		line, err := br.ReadBytes('\n')
+		if err == io.EOF {
+			if len(line) > 0 {
+				return size, errIncompleteLine
+			}
+			return size, nil
+		}
+		if err != nil {
+			return size, err
+		}
+		size += int64(len(line))
+		line = line[:len(line)-1]
+		if err := fn(line, sha256.Sum256(line)); err != nil {
+			return size, err
+		}
+	}
+}
+
+// errIncompleteLine is returned by scanArchive for archives ending
+// with a line without a line ending, which was not completely written.
+var errIncompleteLine = errors.New("incomplete last line")
+
+// archiveWriters holds the writers of archives by path.
+var archiveWriters = caddy.NewUsagePool()
+
+// Archive line types.
+const (
+	archiveRecord = "record"
+	archiveSeal   = "seal"
+)
+
+const (
+	defaultSealEvery    = 100
+	defaultSealInterval = time.Minute
+)
@@ -0,0 +1,128 @@
+// Copyright 2021 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package form2json
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+func TestOpenArchiveIncompleteLine(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "archive.jsonl")
+	pub, key := newArchiveKey(t)
+	writeArchive(t, path, key, "first", "second")
+
+	// a crash while writing the third record leaves part of its line
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, append(data, `{"type":"record","seq":3,"ti`...), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	writeArchive(t, path, key, "third")
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	result, err := verifyArchive(f, pub)
+	if err != nil {
+		t.Fatalf("line %d: %v", result.lines+1, err)
+	}
+	if result.records != 3 || result.seals != 2 || result.unsealed != 0 {
+		t.Errorf("expected 3 records and 2 seals, got %+v", result)
+	}
+}
+
+func TestVerifyArchive(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "archive.jsonl")
+	pub, key := newArchiveKey(t)
+	writeArchive(t, path, key, "first", "second")
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.SplitAfter(string(data), "\n")
+	otherPub, _ := newArchiveKey(t)
+
+	for i, tc := range []struct {
+		archive  string
+		pub      ed25519.PublicKey
+		unsealed int
+		err      string
+	}{
+		{archive: string(data), pub: pub},
+		{archive: string(data), pub: otherPub, err: "invalid seal signature"},
+		{archive: lines[0] + lines[1], pub: pub, unsealed: 2},
+		{archive: lines[0] + lines[2], pub: pub, err: "sequence number is 2, expected 1"},
+		{archive: strings.Replace(string(data), "Zmlyc3Q=", "Zmlyc3u=", 1), pub: pub, err: "hash of the previous line does not match"},
+		{archive: string(data) + lines[0][:10], pub: pub, err: "incomplete last line"},
+	} {
+		result, err := verifyArchive(strings.NewReader(tc.archive), tc.pub)
+		if tc.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Errorf("Test %d: expected an error containing %q, got %v", i, tc.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test %d: unexpected error: %v", i, err)
+			continue
+		}
+		if result.unsealed != tc.unsealed {
+			t.Errorf("Test %d: expected %d unsealed records, got %d", i, tc.unsealed, result.unsealed)
+		}
+	}
+}
+
+func newArchiveKey(t *testing.T) (ed25519.PublicKey, ed25519.PrivateKey) {
+	pub, key, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pub, key
+}
+
+// writeArchive opens the archive at path, appends a record for each
+// of payloads, and closes it, which seals it.
+func writeArchive(t *testing.T, path string, key ed25519.PrivateKey, payloads ...string) {
+	aw, err := openArchive(path, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	aw.configure(key, len(payloads)+1, time.Hour)
+	for _, payload := range payloads {
+		err := aw.append(archiveEntry{Type: archiveRecord, Payload: []byte(payload)})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := aw.Destruct(); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := ioutil.ReadFile(path); err != nil || !bytes.HasSuffix(data, []byte("\n")) {
+		t.Fatalf("expected the archive to end with a complete line (%v)", err)
+	}
+}
@@ -0,0 +1,104 @@
+// Copyright 2021 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package backend helps Go services consume requests converted by the
+// form2json handler.
+package backend
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"strings"
+)
+
+// Related is a decoded multipart/related payload, as produced by the
+// "related" encoder.
+type Related struct {
+	// Root is the JSON root part, in which file values are "cid:"
+	// references to Files.
+	Root json.RawMessage
+
+	// Files maps Content-IDs (without angle brackets) to files.
+	Files map[string]*RelatedFile
+}
+
+// RelatedFile is a file carried in its own part of a multipart/related
+// payload.
+type RelatedFile struct {
+	ContentType string
+	FileName    string
+	Data        []byte
+}
+
+// File returns the file referred to by ref, a "cid:" URL from the root.
+func (rel *Related) File(ref string) (*RelatedFile, bool) {
+	f, ok := rel.Files[strings.TrimPrefix(ref, "cid:")]
+	return f, ok
+}
+
+// DecodeRelated reads the multipart/related payload of r. Payloads
+// larger than maxBytes are rejected.
+func DecodeRelated(r *http.Request, maxBytes int64) (*Related, error) {
+	mediaType, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		return nil, err
+	}
+	if mediaType != "multipart/related" {
+		return nil, fmt.Errorf("unexpected content type: %s", mediaType)
+	}
+	start := strings.Trim(params["start"], "<>")
+
+	body := io.LimitReader(r.Body, maxBytes+1)
+	mr := multipart.NewReader(body, params["boundary"])
+	rel := &Related{Files: make(map[string]*RelatedFile)}
+	var read int64
+	for first := true; ; first = false {
+		p, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		data, err := ioutil.ReadAll(p)
+		if err != nil {
+			return nil, err
+		}
+		read += int64(len(data))
+		if read > maxBytes {
+			return nil, fmt.Errorf("payload exceeds %d bytes", maxBytes)
+		}
+
+		id := strings.Trim(p.Header.Get("Content-ID"), "<>")
+		if (start == "" && first) || (start != "" && id == start) {
+			rel.Root = data
+			continue
+		}
+		_, dispParams, _ := mime.ParseMediaType(p.Header.Get("Content-Disposition"))
+		rel.Files[id] = &RelatedFile{
+			ContentType: p.Header.Get("Content-Type"),
+			FileName:    dispParams["filename"],
+			Data:        data,
+		}
+	}
+	if rel.Root == nil {
+		return nil, fmt.Errorf("missing root part")
+	}
+	return rel, nil
+}
@@ -0,0 +1,126 @@
+// Copyright 2021 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package backend
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestDecodeRelated(t *testing.T) {
+	const root = `{"photo":{"type":"file/related","value":"cid:1.b@form2json"}}`
+	body := "--b\r\n" +
+		"Content-Type: application/json\r\n" +
+		"Content-ID: <root.b@form2json>\r\n\r\n" +
+		root + "\r\n" +
+		"--b\r\n" +
+		"Content-Type: image/png\r\n" +
+		"Content-ID: <1.b@form2json>\r\n" +
+		`Content-Disposition: attachment; name="photo"; filename="a \"1\".png"` + "\r\n\r\n" +
+		"img\r\n" +
+		"--b--\r\n"
+	// the same parts, with the root last
+	rootLast := "--b\r\n" +
+		"Content-Type: image/png\r\n" +
+		"Content-ID: <1.b@form2json>\r\n" +
+		`Content-Disposition: attachment; name="photo"; filename="a \"1\".png"` + "\r\n\r\n" +
+		"img\r\n" +
+		"--b\r\n" +
+		"Content-Type: application/json\r\n" +
+		"Content-ID: <root.b@form2json>\r\n\r\n" +
+		root + "\r\n" +
+		"--b--\r\n"
+
+	for i, tc := range []struct {
+		contentType string
+		body        string
+		maxBytes    int64
+		expectErr   bool
+	}{
+		{
+			contentType: `multipart/related; type="application/json"; start="<root.b@form2json>"; boundary=b`,
+			body:        body,
+		},
+		{
+			contentType: `multipart/related; type="application/json"; start="<root.b@form2json>"; boundary=b`,
+			body:        rootLast,
+		},
+		{
+			// without a start parameter, the first part is the root
+			contentType: `multipart/related; type="application/json"; boundary=b`,
+			body:        body,
+		},
+		{
+			contentType: `multipart/related; type="application/json"; start="<root.b@form2json>"; boundary=b`,
+			body:        body,
+			maxBytes:    int64(len(root) + 2),
+			expectErr:   true,
+		},
+		{
+			contentType: `multipart/form-data; boundary=b`,
+			body:        body,
+			expectErr:   true,
+		},
+		{
+			contentType: `multipart/related; start="<other@form2json>"; boundary=b`,
+			body:        body,
+			expectErr:   true,
+		},
+		{
+			contentType: `multipart/related; boundary=b`,
+			body:        "--b\r\nContent-Type: text/plain\r\n\r\nx",
+			expectErr:   true,
+		},
+		{
+			contentType: `multipart/related; boundary="`,
+			body:        body,
+			expectErr:   true,
+		},
+	} {
+		req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(tc.body))
+		req.Header.Set("Content-Type", tc.contentType)
+		maxBytes := tc.maxBytes
+		if maxBytes == 0 {
+			maxBytes = 1 << 20
+		}
+		rel, err := DecodeRelated(req, maxBytes)
+		if tc.expectErr {
+			if err == nil {
+				t.Errorf("Test %d: expected an error", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test %d: unexpected error: %v", i, err)
+			continue
+		}
+		if string(rel.Root) != root {
+			t.Errorf("Test %d: expected root %s, got %s", i, root, rel.Root)
+		}
+		f, ok := rel.File("cid:1.b@form2json")
+		if !ok {
+			t.Errorf("Test %d: expected file 1.b@form2json, got %v", i, rel.Files)
+			continue
+		}
+		if f.ContentType != "image/png" || f.FileName != `a "1".png` || string(f.Data) != "img" {
+			t.Errorf("Test %d: unexpected file %+v", i, f)
+		}
+		if _, ok := rel.File("cid:2.b@form2json"); ok {
+			t.Errorf("Test %d: expected no file 2.b@form2json", i)
+		}
+	}
+}
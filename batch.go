@@ -0,0 +1,284 @@
+// Copyright 2021 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package form2json
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+// Batch splits submissions of bulk-entry forms into one request per
+// row. Each row's body holds the fields of the row (named by their key
+// within the group) along with all fields outside the group, encoded
+// in the configured mode. The submission as a whole is still archived
+// and published, and debug echoes show the body of every row.
+type Batch struct {
+	// The name of the group whose rows are split. Required.
+	Group string `json:"group"`
+
+	// If set, rows are POSTed to this URL instead of being passed to
+	// the next handler. Placeholders are evaluated at provision time.
+	URL string `json:"url,omitempty"`
+
+	// The maximum number of rows sent concurrently. Default: 4
+	Concurrency int `json:"concurrency,omitempty"`
+
+	// How long to wait for each row's response when posting to URL.
+	// Default: 30s
+	Timeout caddy.Duration `json:"timeout,omitempty"`
+
+	client *http.Client
+}
+
+func (b *Batch) provision(repl *caddy.Replacer) error {
+	if b.Group == "" {
+		return fmt.Errorf("group is required")
+	}
+	if b.Concurrency <= 0 {
+		b.Concurrency = defaultBatchConcurrency
+	}
+	if b.Timeout <= 0 {
+		b.Timeout = caddy.Duration(defaultBatchTimeout)
+	}
+	b.URL = repl.ReplaceAll(b.URL, "")
+	b.client = &http.Client{Timeout: time.Duration(b.Timeout)}
+	return nil
+}
+
+// hasGroup returns true if a group rule with the given name exists.
+func (h Handler) hasGroup(name string) bool {
+	for _, rule := range h.Groups {
+		if rule.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// split separates the rows of the batch group of converted from the
+// parts outside the group, which are shared by all rows.
+func (b *Batch) split(converted []part) ([]partGroup, []part, error) {
+	var rows []partGroup
+	var shared []part
+	for _, p := range converted {
+		if p.rows != nil && p.Name == b.Group {
+			rows = p.rows
+			continue
+		}
+		shared = append(shared, p)
+	}
+	if len(rows) == 0 {
+		return nil, nil, caddyhttp.Error(http.StatusBadRequest, fieldError{
+			Field:   b.Group,
+			Message: "no rows submitted",
+		})
+	}
+	return rows, shared, nil
+}
+
+// rowParts returns the parts of the request for row.
+func rowParts(shared []part, row partGroup) []part {
+	parts := make([]part, 0, len(shared)+len(row.parts))
+	parts = append(parts, shared...)
+	return append(parts, row.parts...)
+}
+
+// echoRows returns the bodies the rows of a batch would be sent with,
+// for a debug echo.
+func (h Handler) echoRows(rows []partGroup, shared []part, original map[string]interface{}, id string) ([]debugRow, error) {
+	echoed := make([]debugRow, len(rows))
+	for i, row := range rows {
+		body := new(bytes.Buffer)
+		if _, _, err := h.encode(body, rowParts(shared, row), original, id); err != nil {
+			return nil, err
+		}
+		echoed[i] = debugRow{Index: row.index, Body: echoBody(body.Bytes())}
+	}
+	return echoed, nil
+}
+
+// serveBatch sends each row of the batch group as its own request, with
+// bounded concurrency, and responds with the results of all rows.
+func (h Handler) serveBatch(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler, rows []partGroup, shared []part, original map[string]interface{}, id string) error {
+	results := make([]batchResult, len(rows))
+	sem := make(chan struct{}, h.Batch.Concurrency)
+	var wg sync.WaitGroup
+	for i, row := range rows {
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(i int, row partGroup) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			results[i] = h.sendRow(r, next, rowParts(shared, row), original, id)
+			results[i].Index = row.index
+		}(i, row)
+	}
+	wg.Wait()
+
+	resp := batchResponse{Results: results}
+	for _, res := range results {
+		if res.Status >= 200 && res.Status < 300 {
+			resp.Succeeded++
+		} else {
+			resp.Failed++
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if resp.Failed > 0 {
+		w.WriteHeader(http.StatusMultiStatus)
+	}
+	return json.NewEncoder(w).Encode(resp)
+}
+
+// sendRow encodes parts and sends them to the batch URL, or to next.
+func (h Handler) sendRow(r *http.Request, next caddyhttp.Handler, parts []part, original map[string]interface{}, id string) batchResult {
+	body := new(bytes.Buffer)
+	contentType, class, err := h.encode(body, parts, original, id)
+	if err != nil {
+		return batchResult{Status: http.StatusInternalServerError, Error: err.Error()}
+	}
+
+	if h.Batch.URL != "" {
+		req, err := http.NewRequestWithContext(r.Context(), http.MethodPost, h.Batch.URL, body)
+		if err != nil {
+			return batchResult{Status: http.StatusInternalServerError, Error: err.Error()}
+		}
+		req.Header.Set("Content-Type", contentType)
+		req.Header.Set("Content-Type-Class", class)
+		req.Header.Set(h.SubmissionIDHeader, id)
+		resp, err := h.Batch.client.Do(req)
+		if err != nil {
+			return batchResult{Status: http.StatusBadGateway, Error: err.Error()}
+		}
+		defer resp.Body.Close()
+		respBody, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxBatchResponseBytes))
+		if err != nil {
+			return batchResult{Status: http.StatusBadGateway, Error: err.Error()}
+		}
+		return batchResult{Status: resp.StatusCode, Body: responseValue(respBody)}
+	}
+
+	// each row gets its own replacer and variables, so that values set
+	// by later handlers (such as reverse_proxy's upstream placeholders)
+	// don't race; they start out with the values of the original
+	parentRepl, _ := r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+	rowRepl := caddy.NewReplacer()
+	if parentRepl != nil {
+		rowRepl.Map(parentRepl.Get)
+	}
+	ctx := context.WithValue(r.Context(), caddy.ReplacerCtxKey, rowRepl)
+	if parentVars, ok := r.Context().Value(caddyhttp.VarsCtxKey).(map[string]interface{}); ok {
+		rowVars := make(map[string]interface{}, len(parentVars))
+		for k, v := range parentVars {
+			rowVars[k] = v
+		}
+		ctx = context.WithValue(ctx, caddyhttp.VarsCtxKey, rowVars)
+	}
+
+	req := r.Clone(ctx)
+	req.Body = ioutil.NopCloser(body)
+	req.ContentLength = int64(body.Len())
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("Content-Type-Class", class)
+	req.Header.Set("Content-Length", strconv.Itoa(body.Len()))
+
+	rec := &rowRecorder{header: make(http.Header)}
+	if err := next.ServeHTTP(rec, req); err != nil {
+		status := http.StatusInternalServerError
+		if herr, ok := err.(caddyhttp.HandlerError); ok && herr.StatusCode != 0 {
+			status = herr.StatusCode
+		}
+		return batchResult{Status: status, Error: err.Error()}
+	}
+	return batchResult{Status: rec.statusCode(), Body: responseValue(rec.body.Bytes())}
+}
+
+// responseValue returns body as raw JSON if it is JSON, or as a string.
+func responseValue(body []byte) interface{} {
+	if len(body) == 0 {
+		return nil
+	}
+	if json.Valid(body) {
+		return json.RawMessage(body)
+	}
+	return string(body)
+}
+
+// rowRecorder records the response of the next handler for one row.
+// Unlike caddyhttp.ResponseRecorder, it does not share the header map
+// of the client's response, so rows can be handled concurrently.
+type rowRecorder struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (rr *rowRecorder) Header() http.Header { return rr.header }
+
+func (rr *rowRecorder) WriteHeader(status int) {
+	if rr.status == 0 {
+		rr.status = status
+	}
+}
+
+func (rr *rowRecorder) Write(p []byte) (int, error) {
+	rr.WriteHeader(http.StatusOK)
+	if rr.body.Len()+len(p) > maxBatchResponseBytes {
+		return 0, fmt.Errorf("row response too large")
+	}
+	return rr.body.Write(p)
+}
+
+func (rr *rowRecorder) statusCode() int {
+	if rr.status == 0 {
+		return http.StatusOK
+	}
+	return rr.status
+}
+
+// batchResponse is the response body of a batch submission.
+type batchResponse struct {
+	Succeeded int           `json:"succeeded"`
+	Failed    int           `json:"failed"`
+	Results   []batchResult `json:"results"`
+}
+
+// batchResult is the outcome of sending a single row.
+type batchResult struct {
+	Index  string      `json:"index"`
+	Status int         `json:"status"`
+	Body   interface{} `json:"body,omitempty"`
+	Error  string      `json:"error,omitempty"`
+}
+
+const (
+	defaultBatchConcurrency = 4
+	defaultBatchTimeout     = 30 * time.Second
+	maxBatchResponseBytes   = 1 << 20
+)
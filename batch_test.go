@@ -0,0 +1,261 @@
+// Copyright 2021 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package form2json
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+func TestBatchSplit(t *testing.T) {
+	b := Batch{Group: "people"}
+	rows := []partGroup{{index: "1"}, {index: "2"}}
+	converted := []part{
+		{Name: "title", Type: "text"},
+		{Name: "people", Type: "group", rows: rows},
+		{Name: "others", Type: "group", rows: []partGroup{{index: "1"}}},
+	}
+	actualRows, shared, err := b.split(converted)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(actualRows) != 2 || actualRows[1].index != "2" {
+		t.Errorf("expected rows %v, got %v", rows, actualRows)
+	}
+	if len(shared) != 2 || shared[0].Name != "title" || shared[1].Name != "others" {
+		t.Errorf("expected shared parts title and others, got %v", shared)
+	}
+
+	_, _, err = b.split([]part{{Name: "people", Type: "text"}})
+	if statusOf(err) != http.StatusBadRequest {
+		t.Errorf("expected status 400 without rows, got %v", err)
+	}
+}
+
+// newBatchHandler returns a handler splitting the rows of name_N and
+// status_N fields.
+func newBatchHandler(t *testing.T, batch *Batch) Handler {
+	h := newTestHandler()
+	h.Mode = modeObject
+	rule := &GroupRule{Name: "people", Pattern: `^(?P<key>[a-z]+)_(?P<index>\d+)$`}
+	if err := rule.provision(); err != nil {
+		t.Fatal(err)
+	}
+	h.Groups = []*GroupRule{rule}
+	if err := batch.provision(caddy.NewReplacer()); err != nil {
+		t.Fatal(err)
+	}
+	h.Batch = batch
+	return h
+}
+
+// rowFields are the fields of a batch of three rows, the second of
+// which the upstream rejects.
+var rowFields = []testField{
+	{name: "title", value: "team"},
+	{name: "name_10", value: "carol"},
+	{name: "name_2", value: "bob"},
+	{name: "status_2", value: "422"},
+	{name: "name_1", value: "alice"},
+}
+
+// serveRow responds to a row with the status it asks for, echoing the
+// row's body.
+func serveRow(w http.ResponseWriter, r *http.Request) error {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return err
+	}
+	var row map[string]interface{}
+	if err := json.Unmarshal(body, &row); err != nil {
+		return err
+	}
+	if row["title"] != "team" {
+		return caddyhttp.Error(http.StatusBadRequest, nil)
+	}
+	if row["status"] == "422" {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		return nil
+	}
+	if row["status"] == "409" {
+		return caddyhttp.Error(http.StatusConflict, nil)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, err = w.Write(body)
+	return err
+}
+
+func TestBatchRequests(t *testing.T) {
+	for i, tc := range []struct {
+		fields   []testField
+		status   int
+		expected string
+	}{
+		{
+			fields: rowFields[:2],
+			status: http.StatusOK,
+			expected: `{"succeeded":1,"failed":0,"results":[` +
+				`{"index":"10","status":200,"body":{"name":"carol","title":"team"}}]}`,
+		},
+		{
+			fields: rowFields,
+			status: http.StatusMultiStatus,
+			expected: `{"succeeded":2,"failed":1,"results":[` +
+				`{"index":"1","status":200,"body":{"name":"alice","title":"team"}},` +
+				`{"index":"2","status":422},` +
+				`{"index":"10","status":200,"body":{"name":"carol","title":"team"}}]}`,
+		},
+	} {
+		h := newBatchHandler(t, &Batch{Group: "people"})
+		w := httptest.NewRecorder()
+		err := h.ServeHTTP(w, newFormRequest(t, tc.fields...), caddyhttp.HandlerFunc(serveRow))
+		if err != nil {
+			t.Errorf("Test %d: unexpected error: %v", i, err)
+			continue
+		}
+		if w.Code != tc.status {
+			t.Errorf("Test %d: expected status %d, got %d", i, tc.status, w.Code)
+		}
+		if actual := w.Body.String(); actual != tc.expected+"\n" {
+			t.Errorf("Test %d: expected:\n%s\ngot:\n%s", i, tc.expected, actual)
+		}
+	}
+
+	// errors of the next handler are reported with their status
+	h := newBatchHandler(t, &Batch{Group: "people"})
+	w := httptest.NewRecorder()
+	fields := []testField{{name: "name_1", value: "x"}, {name: "status_1", value: "409"}, {name: "title", value: "team"}}
+	if err := h.ServeHTTP(w, newFormRequest(t, fields...), caddyhttp.HandlerFunc(serveRow)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var resp batchResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Failed != 1 || resp.Results[0].Status != http.StatusConflict || resp.Results[0].Error == "" {
+		t.Errorf("expected row to fail with status 409 and an error, got %+v", resp)
+	}
+
+	// a submission without rows fails as a whole
+	_, next, err := serveTest(t, h, newFormRequest(t, testField{name: "title", value: "team"}))
+	if statusOf(err) != http.StatusBadRequest || next.called {
+		t.Errorf("expected status 400 without rows, got %v", err)
+	}
+}
+
+func TestBatchConcurrency(t *testing.T) {
+	var mu sync.Mutex
+	var active, maxActive int
+	entered, release := make(chan struct{}), make(chan struct{})
+	next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		mu.Lock()
+		active++
+		if active > maxActive {
+			maxActive = active
+		}
+		mu.Unlock()
+		entered <- struct{}{}
+		<-release
+		mu.Lock()
+		active--
+		mu.Unlock()
+		return nil
+	})
+
+	var fields []testField
+	for _, index := range []string{"1", "2", "3", "4", "5"} {
+		fields = append(fields, testField{name: "name_" + index, value: index})
+	}
+	h := newBatchHandler(t, &Batch{Group: "people", Concurrency: 2})
+	done := make(chan error)
+	w := httptest.NewRecorder()
+	go func() { done <- h.ServeHTTP(w, newFormRequest(t, fields...), next) }()
+	// each row after the first two is only sent once another finishes
+	<-entered
+	<-entered
+	for i := 2; i < len(fields); i++ {
+		release <- struct{}{}
+		<-entered
+	}
+	release <- struct{}{}
+	release <- struct{}{}
+	if err := <-done; err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if maxActive != 2 {
+		t.Errorf("expected 2 rows to be sent concurrently, got %d", maxActive)
+	}
+	var resp batchResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Succeeded != len(fields) {
+		t.Errorf("expected %d rows to succeed, got %d", len(fields), resp.Succeeded)
+	}
+}
+
+func TestBatchURL(t *testing.T) {
+	var mu sync.Mutex
+	headers := make(map[string]http.Header)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		var row map[string]interface{}
+		json.Unmarshal(body, &row)
+		mu.Lock()
+		headers[row["name"].(string)] = r.Header
+		mu.Unlock()
+		if row["status"] == "422" {
+			http.Error(w, "rejected", http.StatusUnprocessableEntity)
+			return
+		}
+		w.Write([]byte(`{"ok":true}`))
+	}))
+	defer srv.Close()
+
+	h := newBatchHandler(t, &Batch{Group: "people", URL: srv.URL})
+	w, next, err := serveTest(t, h, newFormRequest(t, rowFields...))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if next.called {
+		t.Error("expected rows not to be passed to the next handler")
+	}
+	expected := `{"succeeded":2,"failed":1,"results":[` +
+		`{"index":"1","status":200,"body":{"ok":true}},` +
+		`{"index":"2","status":422,"body":"rejected\n"},` +
+		`{"index":"10","status":200,"body":{"ok":true}}]}` + "\n"
+	if actual := w.Body.String(); actual != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, actual)
+	}
+	id := headers["alice"].Get(defaultSubmissionIDHeader)
+	if id == "" {
+		t.Error("expected rows to carry the submission ID")
+	}
+	for name, header := range headers {
+		if header.Get(defaultSubmissionIDHeader) != id {
+			t.Errorf("%s: expected submission ID %s, got %s", name, id, header.Get(defaultSubmissionIDHeader))
+		}
+		if header.Get("Content-Type") != "application/json" {
+			t.Errorf("%s: expected content type application/json, got %s", name, header.Get("Content-Type"))
+		}
+	}
+}
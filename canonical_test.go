@@ -0,0 +1,134 @@
+// Copyright 2021 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package form2json
+
+import (
+	"math"
+	"testing"
+)
+
+// The number serialization samples of RFC 8785, Appendix B.
+func TestCanonicalNumber(t *testing.T) {
+	for i, tc := range []struct {
+		bits     uint64
+		expected string
+	}{
+		{0x0000000000000000, "0"},
+		{0x8000000000000000, "0"}, // minus zero
+		{0x0000000000000001, "5e-324"},
+		{0x8000000000000001, "-5e-324"},
+		{0x7fefffffffffffff, "1.7976931348623157e+308"},
+		{0xffefffffffffffff, "-1.7976931348623157e+308"},
+		{0x4340000000000000, "9007199254740992"},
+		{0xc340000000000000, "-9007199254740992"},
+		{0x4430000000000000, "295147905179352830000"},
+		{0x44b52d02c7e14af5, "9.999999999999997e+22"},
+		{0x44b52d02c7e14af6, "1e+23"},
+		{0x44b52d02c7e14af7, "1.0000000000000001e+23"},
+		{0x444b1ae4d6e2ef4e, "999999999999999700000"},
+		{0x444b1ae4d6e2ef4f, "999999999999999900000"},
+		{0x444b1ae4d6e2ef50, "1e+21"},
+		{0x3eb0c6f7a0b5ed8c, "9.999999999999997e-7"},
+		{0x3eb0c6f7a0b5ed8d, "0.000001"},
+		{0x41b3de4355555553, "333333333.3333332"},
+		{0x41b3de4355555554, "333333333.33333325"},
+		{0x41b3de4355555555, "333333333.3333333"},
+		{0x41b3de4355555556, "333333333.3333334"},
+		{0x41b3de4355555557, "333333333.33333343"},
+		{0xbecbf647612f3696, "-0.0000033333333333333333"},
+		{0x43143ff3c1cb0959, "1424953923781206.2"},
+	} {
+		actual, err := canonicalNumber(math.Float64frombits(tc.bits))
+		if err != nil {
+			t.Errorf("Test %d (%016x): unexpected error: %v", i, tc.bits, err)
+			continue
+		}
+		if actual != tc.expected {
+			t.Errorf("Test %d (%016x): expected %s, got %s", i, tc.bits, tc.expected, actual)
+		}
+	}
+
+	for _, bits := range []uint64{0x7fffffffffffffff, 0x7ff0000000000000} {
+		if s, err := canonicalNumber(math.Float64frombits(bits)); err == nil {
+			t.Errorf("%016x: expected an error, got %s", bits, s)
+		}
+	}
+}
+
+func TestCanonicalJSON(t *testing.T) {
+	for i, tc := range []struct {
+		input    string
+		expected string
+	}{
+		// RFC 8785, section 3.2.2
+		{
+			input: `{
+				"numbers": [333333333.33333329, 1E30, 4.50, 2e-3, 0.000000000000000000000000001],
+				"string": "\u20ac$\u000F\u000aA'\u0042\u0022\u005c\\\"\/",
+				"literals": [null, true, false]
+			}`,
+			expected: `{"literals":[null,true,false],"numbers":[333333333.3333333,1e+30,4.5,0.002,1e-27],"string":"€$\u000f\nA'B\"\\\\\"/"}`,
+		},
+		// RFC 8785, section 3.2.3: keys are sorted by UTF-16 code units
+		{
+			input: `{
+				"\u20ac": "Euro Sign",
+				"\r": "Carriage Return",
+				"\ufb33": "Hebrew Letter Dalet With Dagesh",
+				"1": "One",
+				"\ud83d\ude00": "Emoji: Grinning Face",
+				"\u0080": "Control",
+				"\u00f6": "Latin Small Letter O With Diaeresis"
+			}`,
+			expected: "{\"\\r\":\"Carriage Return\",\"1\":\"One\",\"\u0080\":\"Control\",\"ö\":\"Latin Small Letter O With Diaeresis\",\"€\":\"Euro Sign\",\"😀\":\"Emoji: Grinning Face\",\"\ufb33\":\"Hebrew Letter Dalet With Dagesh\"}",
+		},
+		// integers beyond 2^53 lose precision, as they would in ECMAScript
+		{
+			input:    `[9007199254740993, -0, -0.0, 1e21, 1e-7, 100]`,
+			expected: `[9007199254740992,0,0,1e+21,1e-7,100]`,
+		},
+		// control characters are escaped, other characters are not
+		{
+			input:    `["\u0000\u0008\u000c\u001f\u007f<>&\u2028"]`,
+			expected: "[\"\\u0000\\b\\f\\u001f\u007f<>&\u2028\"]",
+		},
+		// nesting and whitespace
+		{
+			input:    ` { "b" : [ { "d" : 1 , "c" : 2 } ] , "a" : { } } `,
+			expected: `{"a":{},"b":[{"c":2,"d":1}]}`,
+		},
+	} {
+		actual, err := canonicalJSON([]byte(tc.input))
+		if err != nil {
+			t.Errorf("Test %d: unexpected error: %v", i, err)
+			continue
+		}
+		if string(actual) != tc.expected {
+			t.Errorf("Test %d: expected:\n%s\ngot:\n%s", i, tc.expected, actual)
+		}
+	}
+}
+
+func TestCanonicalJSONInvalid(t *testing.T) {
+	for i, input := range []string{
+		`{"a":1} {"b":2}`,
+		`{"a":}`,
+		`[1e400]`,
+	} {
+		if actual, err := canonicalJSON([]byte(input)); err == nil {
+			t.Errorf("Test %d: expected an error, got %s", i, actual)
+		}
+	}
+}
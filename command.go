@@ -0,0 +1,137 @@
+// Copyright 2021 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package form2json
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/caddyserver/caddy/v2"
+	caddycmd "github.com/caddyserver/caddy/v2/cmd"
+)
+
+func init() {
+	caddycmd.RegisterCommand(caddycmd.Command{
+		Name:  "form2json-verify",
+		Func:  cmdVerify,
+		Usage: "--archive <path> [--public-key <base64>]",
+		Short: "Verifies a form2json submission archive",
+		Long: `
+Walks the hash chain of a form2json submission archive, checking that
+each line holds the hash of the line before it, and reports the first
+broken link. If the public key of the archive's signing key is given,
+the signature of each seal is verified as well.
+
+Records after the last seal are only protected by the chain, and could
+be altered or removed along with its end. The command exits with status
+1 if the archive is broken, and with status 4 if its chain is intact but
+ends with unsealed records.`,
+		Flags: func() *flag.FlagSet {
+			fs := flag.NewFlagSet("form2json-verify", flag.ExitOnError)
+			fs.String("archive", "", "The archive file to verify")
+			fs.String("public-key", "", "The base64-encoded Ed25519 public key of the seals")
+			return fs
+		}(),
+	})
+}
+
+func cmdVerify(fl caddycmd.Flags) (int, error) {
+	path := fl.String("archive")
+	if path == "" {
+		return caddy.ExitCodeFailedStartup, fmt.Errorf("--archive is required")
+	}
+	var pub ed25519.PublicKey
+	if s := fl.String("public-key"); s != "" {
+		key, err := base64.StdEncoding.DecodeString(s)
+		if err != nil || len(key) != ed25519.PublicKeySize {
+			return caddy.ExitCodeFailedStartup, fmt.Errorf("--public-key must be a base64-encoded Ed25519 public key")
+		}
+		pub = key
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+	defer f.Close()
+
+	result, err := verifyArchive(f, pub)
+	fmt.Printf("%d records, %d seals\n", result.records, result.seals)
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, fmt.Errorf("line %d: %v", result.lines+1, err)
+	}
+	if pub == nil {
+		fmt.Println("Seal signatures were not verified (no --public-key given)")
+	}
+	if result.unsealed > 0 {
+		return exitCodeUnsealed, fmt.Errorf("%d records after the last seal are not sealed", result.unsealed)
+	}
+	fmt.Println("Archive is intact")
+	return caddy.ExitCodeSuccess, nil
+}
+
+// exitCodeUnsealed is the exit status of the verify command for
+// archives whose chain is intact, but ends with unsealed records.
+const exitCodeUnsealed = 4
+
+// archiveResult summarizes a verified archive.
+type archiveResult struct {
+	lines    int // lines verified
+	records  int
+	seals    int
+	unsealed int // records after the last seal
+}
+
+// verifyArchive verifies the chain of the archive read from r, and
+// the seals if pub is not nil. It stops at the first broken link.
+func verifyArchive(r io.Reader, pub ed25519.PublicKey) (archiveResult, error) {
+	var result archiveResult
+	var prev [32]byte
+	_, err := scanArchive(r, func(line []byte, hash [32]byte) error {
+		var e archiveEntry
+		if err := json.Unmarshal(line, &e); err != nil {
+			return fmt.Errorf("malformed line: %v", err)
+		}
+		if e.Seq != uint64(result.lines) {
+			return fmt.Errorf("sequence number is %d, expected %d", e.Seq, result.lines)
+		}
+		if e.Prev != hex.EncodeToString(prev[:]) {
+			return fmt.Errorf("hash of the previous line does not match; the previous line was altered, or lines were removed or reordered")
+		}
+		switch e.Type {
+		case archiveRecord:
+			result.records++
+			result.unsealed++
+		case archiveSeal:
+			if pub != nil && !ed25519.Verify(pub, sealMessage(e.Seq, e.Prev), e.Signature) {
+				return fmt.Errorf("invalid seal signature")
+			}
+			result.seals++
+			result.unsealed = 0
+		default:
+			return fmt.Errorf("unknown line type %q", e.Type)
+		}
+		prev = hash
+		result.lines++
+		return nil
+	})
+	return result, err
+}
@@ -0,0 +1,70 @@
+// Copyright 2021 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package form2json
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// compressFile compresses the contents of fp with the configured file
+// encoding into p. If the compressed contents would not be smaller, p is
+// left unchanged and false is returned.
+func (h Handler) compressFile(p *part, fp *formPart) (bool, error) {
+	f, err := fp.Open()
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	compressed := new(bytes.Buffer)
+	var zw io.WriteCloser
+	if h.FileEncoding == fileEncodingZstd {
+		// files are already compressed concurrently by the file workers
+		zw, err = zstd.NewWriter(compressed, zstd.WithEncoderConcurrency(1))
+		if err != nil {
+			return false, err
+		}
+	} else {
+		zw = gzip.NewWriter(compressed)
+	}
+	if _, err := io.Copy(zw, f); err != nil {
+		return false, err
+	}
+	if err := zw.Close(); err != nil {
+		return false, err
+	}
+	if int64(compressed.Len()) >= fp.Size {
+		return false, nil
+	}
+
+	p.Type = "file/" + h.FileEncoding
+	p.Value = base64.StdEncoding.EncodeToString(compressed.Bytes())
+	p.CompressedSize = int64(compressed.Len())
+	return true, nil
+}
+
+// File encodings
+const (
+	fileEncodingBase64 = "base64"
+	fileEncodingGzip   = "gzip+base64"
+	fileEncodingZstd   = "zstd+base64"
+)
+
+const defaultCompressMinSize = 1024
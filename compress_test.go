@@ -0,0 +1,148 @@
+// Copyright 2021 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package form2json
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+func TestCompressFile(t *testing.T) {
+	text := strings.Repeat("form2json compresses text-heavy files. ", 100)
+	random := make([]byte, 4096)
+	if _, err := rand.Read(random); err != nil {
+		t.Fatal(err)
+	}
+
+	for i, tc := range []struct {
+		encoding   string
+		contents   string
+		compressed bool
+	}{
+		{encoding: fileEncodingGzip, contents: text, compressed: true},
+		{encoding: fileEncodingZstd, contents: text, compressed: true},
+		{encoding: fileEncodingGzip, contents: string(random)},
+		{encoding: fileEncodingZstd, contents: string(random)},
+		{encoding: fileEncodingZstd, contents: ""},
+	} {
+		h := newTestHandler()
+		h.FileEncoding = tc.encoding
+		fp := &formPart{FileName: "a.txt", data: []byte(tc.contents), Size: int64(len(tc.contents))}
+		var p part
+		ok, err := h.compressFile(&p, fp)
+		if err != nil {
+			t.Errorf("Test %d: unexpected error: %v", i, err)
+			continue
+		}
+		if ok != tc.compressed {
+			t.Errorf("Test %d: expected compressed to be %t, got %t", i, tc.compressed, ok)
+		}
+		if !ok {
+			if p.Type != "" || p.Value != "" {
+				t.Errorf("Test %d: expected part to be unchanged, got %+v", i, p)
+			}
+			continue
+		}
+		if expected := "file/" + tc.encoding; p.Type != expected {
+			t.Errorf("Test %d: expected type %s, got %s", i, expected, p.Type)
+		}
+		compressed, err := base64.StdEncoding.DecodeString(p.Value)
+		if err != nil {
+			t.Errorf("Test %d: decoding base64: %v", i, err)
+			continue
+		}
+		if p.CompressedSize != int64(len(compressed)) || p.CompressedSize >= fp.Size {
+			t.Errorf("Test %d: expected compressed size %d (below %d), got %d", i, len(compressed), fp.Size, p.CompressedSize)
+		}
+		if actual := decompress(t, tc.encoding, compressed); actual != tc.contents {
+			t.Errorf("Test %d: expected contents to round-trip, got %d bytes", i, len(actual))
+		}
+	}
+}
+
+func TestCompressMinSize(t *testing.T) {
+	text := strings.Repeat("a", 2048)
+	for i, tc := range []struct {
+		encoding string
+		minSize  int64
+		size     int
+		expected string
+	}{
+		{encoding: fileEncodingZstd, minSize: 1024, size: 1023, expected: "file/base64"},
+		{encoding: fileEncodingZstd, minSize: 1024, size: 1024, expected: "file/zstd+base64"},
+		{encoding: fileEncodingGzip, minSize: 2048, size: 2047, expected: "file/base64"},
+		{encoding: fileEncodingGzip, minSize: 2048, size: 2048, expected: "file/gzip+base64"},
+		{encoding: fileEncodingBase64, minSize: 1024, size: 2048, expected: "file/base64"},
+		{encoding: "", minSize: 1024, size: 2048, expected: "file/base64"},
+	} {
+		h := newTestHandler()
+		h.Mode = modeObject
+		h.FileEncoding = tc.encoding
+		h.CompressMinSize = tc.minSize
+		if err := h.Validate(); err != nil {
+			t.Fatalf("Test %d: %v", i, err)
+		}
+		req := newFormRequest(t, testField{name: "doc", value: text[:tc.size], fileName: "a.txt"})
+		_, next, err := serveTest(t, h, req)
+		if err != nil {
+			t.Errorf("Test %d: unexpected error: %v", i, err)
+			continue
+		}
+		var obj map[string]part
+		if err := json.Unmarshal(next.body, &obj); err != nil {
+			t.Fatalf("Test %d: decoding %s: %v", i, next.body, err)
+		}
+		if actual := obj["doc"].Type; actual != tc.expected {
+			t.Errorf("Test %d: expected type %s, got %s", i, tc.expected, actual)
+		}
+		if obj["doc"].Size != int64(tc.size) {
+			t.Errorf("Test %d: expected size %d, got %d", i, tc.size, obj["doc"].Size)
+		}
+	}
+}
+
+// decompress returns the contents of data compressed with encoding.
+func decompress(t *testing.T, encoding string, data []byte) string {
+	var r io.Reader
+	switch encoding {
+	case fileEncodingGzip:
+		zr, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		r = zr
+	case fileEncodingZstd:
+		zr, err := zstd.NewReader(bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer zr.Close()
+		r = zr
+	}
+	contents, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(contents)
+}
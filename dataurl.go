@@ -0,0 +1,135 @@
+// Copyright 2021 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package form2json
+
+import (
+	"encoding/base64"
+	"fmt"
+	"mime"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+// isDataURLField returns true if the named field is configured to
+// contain data URLs.
+func (h Handler) isDataURLField(name string) bool {
+	for _, field := range h.DataURLFields {
+		if field == name {
+			return true
+		}
+	}
+	return false
+}
+
+// dataURLPart decodes the data URL value of fp into a file part with
+// a synthetic file name.
+func (h Handler) dataURLPart(fp *formPart) (*formPart, error) {
+	mediaType, data, err := decodeDataURL(fp.value(), h.MaxFileSize)
+	if err != nil {
+		return nil, caddyhttp.Error(http.StatusBadRequest, fieldError{
+			Field:   fp.Name,
+			Message: err.Error(),
+		})
+	}
+	header := make(textproto.MIMEHeader)
+	header.Set("Content-Type", mediaType)
+	return &formPart{
+		Name:     fp.Name,
+		FileName: dataURLFileName(fp.Name, mediaType),
+		Header:   header,
+		Size:     int64(len(data)),
+		data:     data,
+	}, nil
+}
+
+// decodeDataURL decodes the RFC 2397 data URL s, returning its media
+// type and data. If maxSize > 0, data URLs which would decode to more
+// than maxSize bytes are rejected before decoding.
+func decodeDataURL(s string, maxSize int64) (string, []byte, error) {
+	if !strings.HasPrefix(s, "data:") {
+		return "", nil, fmt.Errorf("not a data URL")
+	}
+	comma := strings.IndexByte(s, ',')
+	if comma < 0 {
+		return "", nil, fmt.Errorf("malformed data URL: missing comma")
+	}
+	meta, payload := s[len("data:"):comma], s[comma+1:]
+
+	isBase64 := strings.HasSuffix(strings.ToLower(meta), ";base64")
+	if isBase64 {
+		meta = meta[:len(meta)-len(";base64")]
+	}
+	if meta == "" || strings.HasPrefix(meta, ";") {
+		meta = "text/plain" + meta
+	}
+	mediaType, params, err := mime.ParseMediaType(meta)
+	if err != nil {
+		return "", nil, fmt.Errorf("malformed data URL media type: %v", err)
+	}
+
+	var data []byte
+	if isBase64 {
+		payload = strings.Map(func(r rune) rune {
+			if r == ' ' || r == '\t' || r == '\r' || r == '\n' {
+				return -1
+			}
+			return r
+		}, payload)
+		if maxSize > 0 && int64(base64.RawStdEncoding.DecodedLen(len(payload))) > maxSize+2 {
+			return "", nil, fmt.Errorf("data URL exceeds maximum size of %d bytes", maxSize)
+		}
+		data, err = base64.StdEncoding.DecodeString(payload)
+		if err != nil {
+			data, err = base64.RawStdEncoding.DecodeString(strings.TrimRight(payload, "="))
+		}
+	} else {
+		var text string
+		text, err = url.PathUnescape(payload)
+		data = []byte(text)
+	}
+	if err != nil {
+		return "", nil, fmt.Errorf("malformed data URL payload: %v", err)
+	}
+
+	return mime.FormatMediaType(mediaType, params), data, nil
+}
+
+// dataURLFileName returns a synthetic filename for a data URL of the
+// given media type posted in the named field.
+func dataURLFileName(name, mediaType string) string {
+	mediaType, _, _ = mime.ParseMediaType(mediaType)
+	ext := dataURLExtensions[mediaType]
+	if ext == "" {
+		if exts, err := mime.ExtensionsByType(mediaType); err == nil && len(exts) > 0 {
+			ext = exts[0]
+		}
+	}
+	return name + ext
+}
+
+// dataURLExtensions maps common data URL media types to extensions,
+// since the system MIME tables are not consistent across platforms.
+var dataURLExtensions = map[string]string{
+	"image/png":     ".png",
+	"image/jpeg":    ".jpg",
+	"image/gif":     ".gif",
+	"image/webp":    ".webp",
+	"image/svg+xml": ".svg",
+	"text/plain":    ".txt",
+}
@@ -0,0 +1,109 @@
+// Copyright 2021 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package form2json
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func TestDecodeDataURL(t *testing.T) {
+	for i, tc := range []struct {
+		input     string
+		maxSize   int64
+		mediaType string
+		data      string
+		err       bool
+	}{
+		{input: "data:image/png;base64,aGVsbG8=", mediaType: "image/png", data: "hello"},
+		{input: "data:image/png;BASE64,aGVs\r\nbG8", mediaType: "image/png", data: "hello"},
+		{input: "data:,hello%20world", mediaType: "text/plain", data: "hello world"},
+		{input: "data:;charset=utf-8,%C3%A9", mediaType: "text/plain; charset=utf-8", data: "é"},
+		{input: "data:text/plain;charset=US-ASCII;base64,aGk=", mediaType: "text/plain; charset=US-ASCII", data: "hi"},
+		{input: "data:image/png;base64,aGVsbG8=", maxSize: 5, mediaType: "image/png", data: "hello"},
+		{input: "data:image/png;base64,aGVsbG8gd29ybGQ=", maxSize: 5, err: true},
+		{input: "data:image/png;base64,!!!", err: true},
+		{input: "data:image/png;base64", err: true},
+		{input: "data:image/;base64,aGk=", err: true},
+		{input: "image/png;base64,aGk=", err: true},
+	} {
+		mediaType, data, err := decodeDataURL(tc.input, tc.maxSize)
+		if tc.err {
+			if err == nil {
+				t.Errorf("Test %d: expected an error, got %s %q", i, mediaType, data)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test %d: unexpected error: %v", i, err)
+			continue
+		}
+		if mediaType != tc.mediaType || string(data) != tc.data {
+			t.Errorf("Test %d: expected %s %q, got %s %q", i, tc.mediaType, tc.data, mediaType, data)
+		}
+	}
+}
+
+func TestDataURLFields(t *testing.T) {
+	for i, tc := range []struct {
+		value     string
+		fileTypes []string
+		status    int
+		expected  part
+	}{
+		{
+			value:    "data:image/png;base64,aGVsbG8=",
+			expected: part{Name: "signature", Type: "file/base64", ContentType: "image/png", FileName: "signature.png", Size: 5, Value: "aGVsbG8="},
+		},
+		{
+			// values which are not data URLs are left alone
+			value:    "John Hancock",
+			expected: part{Name: "signature", Type: "field/text", Value: "John Hancock"},
+		},
+		{
+			value:     "data:text/plain,hello",
+			fileTypes: []string{"image/*"},
+			status:    http.StatusUnsupportedMediaType,
+		},
+		{
+			value:  "data:image/png;base64,!!!",
+			status: http.StatusBadRequest,
+		},
+	} {
+		h := newTestHandler()
+		h.DataURLFields = []string{"signature"}
+		h.FileTypes = tc.fileTypes
+		_, next, err := serveTest(t, h, newFormRequest(t, testField{name: "signature", value: tc.value}))
+		if tc.status != 0 {
+			if statusOf(err) != tc.status {
+				t.Errorf("Test %d: expected status %d, got %v", i, tc.status, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test %d: unexpected error: %v", i, err)
+			continue
+		}
+		parts, err := next.parts()
+		if err != nil {
+			t.Errorf("Test %d: decoding payload: %v", i, err)
+			continue
+		}
+		if len(parts) != 1 || !reflect.DeepEqual(parts[0], tc.expected) {
+			t.Errorf("Test %d: expected %+v, got %s", i, tc.expected, next.body)
+		}
+	}
+}
@@ -0,0 +1,196 @@
+// Copyright 2021 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package form2json
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+// debugEchoEnabled returns true if the converted payload should be
+// echoed back to the client for request r.
+func (h Handler) debugEchoEnabled(r *http.Request) bool {
+	if h.DebugEcho {
+		return true
+	}
+	if h.DebugEchoKey == "" {
+		return false
+	}
+	return validDebugToken(h.DebugEchoKey, r.Header.Get(debugHeader), time.Now(), time.Duration(h.DebugEchoMaxAge))
+}
+
+// validDebugToken returns true if token is an unexpired debug token
+// signed with key, which expires no later than maxAge from now.
+func validDebugToken(key, token string, now time.Time, maxAge time.Duration) bool {
+	parts := strings.SplitN(token, ".", 2)
+	if len(parts) != 2 {
+		return false
+	}
+	expiry, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil || now.Unix() > expiry || expiry > now.Add(maxAge).Unix() {
+		return false
+	}
+	sig, err := hex.DecodeString(parts[1])
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(parts[0]))
+	return hmac.Equal(sig, mac.Sum(nil))
+}
+
+// writeDebugEcho writes echo to w as the response. Echoes of failed
+// submissions have the status code the client would have received.
+func (h Handler) writeDebugEcho(w http.ResponseWriter, echo debugEcho) error {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if echo.Error != nil {
+		w.WriteHeader(echo.Error.Status)
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "\t")
+	return enc.Encode(echo)
+}
+
+// echoBody returns body as it should appear in a debug echo: as raw
+// JSON if it is JSON, as a string if it is text, or else as base64.
+func echoBody(body []byte) interface{} {
+	if json.Valid(body) {
+		return json.RawMessage(body)
+	}
+	if utf8.Valid(body) {
+		return string(body)
+	}
+	return base64.StdEncoding.EncodeToString(body)
+}
+
+// debugLimits returns the limits which apply to submissions, given
+// the size of the converted body.
+func (h Handler) debugLimits(bodySize int) debugLimits {
+	limits := debugLimits{
+		MemoryLimit:         h.MemoryLimit,
+		BodySize:            bodySize,
+		MaxFileSize:         h.MaxFileSize,
+		FileTypes:           h.FileTypes,
+		MaxDirectoryDepth:   h.MaxDirectoryDepth,
+		MaxDirectoryEntries: h.MaxDirectoryEntries,
+		FileWorkers:         h.FileWorkers,
+		MaxFileWorkers:      h.MaxFileWorkers,
+	}
+	if h.Multipart != nil {
+		limits.MaxPartHeaders = h.Multipart.MaxPartHeaders
+		limits.MaxPartHeaderBytes = h.Multipart.MaxPartHeaderBytes
+	}
+	if u := h.UploadGuard; u != nil {
+		limits.UploadGuard = &debugUploadLimits{
+			MinRate:       u.MinRate,
+			MinRateGrace:  debugDuration(u.MinRateGrace),
+			HeaderTimeout: debugDuration(u.HeaderTimeout),
+			BodyTimeout:   debugDuration(u.BodyTimeout),
+			PartTimeout:   debugDuration(u.PartTimeout),
+		}
+	}
+	return limits
+}
+
+// newDebugError returns err as it is reported in a debug echo.
+func newDebugError(err error) *debugError {
+	status := http.StatusInternalServerError
+	if herr, ok := err.(caddyhttp.HandlerError); ok {
+		if herr.StatusCode != 0 {
+			status = herr.StatusCode
+		}
+		err = herr.Err
+	}
+	return &debugError{Status: status, fieldError: asFieldError(err)}
+}
+
+// debugDuration formats d for a debug echo, or returns "" if it is not
+// set.
+func debugDuration(d caddy.Duration) string {
+	if d <= 0 {
+		return ""
+	}
+	return time.Duration(d).String()
+}
+
+// debugEcho is the response body written in debug echo mode. Failed
+// submissions are echoed with the error instead of a body.
+type debugEcho struct {
+	Body    interface{}       `json:"body,omitempty"`
+	Headers map[string]string `json:"headers,omitempty"`
+	Error   *debugError       `json:"error,omitempty"`
+	Timings debugTimings      `json:"timings"`
+	Limits  debugLimits       `json:"limits"`
+
+	// Rows holds the bodies of the rows of a batch submission.
+	Rows []debugRow `json:"rows,omitempty"`
+}
+
+// debugRow is the body one row of a batch would have been sent with.
+type debugRow struct {
+	Index string      `json:"index"`
+	Body  interface{} `json:"body"`
+}
+
+// debugError is the error a failed submission would have been
+// answered with.
+type debugError struct {
+	Status int `json:"status"`
+	fieldError
+}
+
+type debugTimings struct {
+	Parse  string `json:"parse"`
+	Encode string `json:"encode,omitempty"`
+}
+
+type debugLimits struct {
+	MemoryLimit         int64              `json:"memory_limit"`
+	BodySize            int                `json:"body_size,omitempty"`
+	MaxFileSize         int64              `json:"max_file_size,omitempty"`
+	FileTypes           []string           `json:"file_types,omitempty"`
+	MaxDirectoryDepth   int                `json:"max_directory_depth"`
+	MaxDirectoryEntries int                `json:"max_directory_entries"`
+	FileWorkers         int                `json:"file_workers"`
+	MaxFileWorkers      int                `json:"max_file_workers,omitempty"`
+	MaxPartHeaders      int                `json:"max_part_headers,omitempty"`
+	MaxPartHeaderBytes  int                `json:"max_part_header_bytes,omitempty"`
+	UploadGuard         *debugUploadLimits `json:"upload_guard,omitempty"`
+}
+
+type debugUploadLimits struct {
+	MinRate       int64  `json:"min_rate,omitempty"`
+	MinRateGrace  string `json:"min_rate_grace,omitempty"`
+	HeaderTimeout string `json:"header_timeout,omitempty"`
+	BodyTimeout   string `json:"body_timeout,omitempty"`
+	PartTimeout   string `json:"part_timeout,omitempty"`
+}
+
+// debugHeader is the request header carrying a signed debug token.
+const debugHeader = "Form2json-Debug"
+
+const defaultDebugEchoMaxAge = time.Hour
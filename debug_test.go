@@ -0,0 +1,114 @@
+// Copyright 2021 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package form2json
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+func TestValidDebugToken(t *testing.T) {
+	now := time.Unix(1600000000, 0)
+	sign := func(key string, expiry int64) string {
+		s := strconv.FormatInt(expiry, 10)
+		mac := hmac.New(sha256.New, []byte(key))
+		mac.Write([]byte(s))
+		return s + "." + hex.EncodeToString(mac.Sum(nil))
+	}
+	for i, tc := range []struct {
+		token    string
+		expected bool
+	}{
+		{token: sign("secret", now.Unix()+60), expected: true},
+		{token: sign("secret", now.Unix()+3600), expected: true},
+		{token: sign("secret", now.Unix()-1), expected: false},            // expired
+		{token: sign("secret", now.Unix()+3601), expected: false},         // lives too long
+		{token: sign("other", now.Unix()+60), expected: false},            // wrong key
+		{token: strconv.FormatInt(now.Unix()+60, 10), expected: false},    // unsigned
+		{token: sign("secret", now.Unix()+60) + "00", expected: false},    // bad signature
+		{token: "soon." + sign("secret", now.Unix()+60), expected: false}, // bad expiry
+		{token: "", expected: false},
+	} {
+		if actual := validDebugToken("secret", tc.token, now, time.Hour); actual != tc.expected {
+			t.Errorf("Test %d: expected %t, got %t", i, tc.expected, actual)
+		}
+	}
+}
+
+func TestDebugEcho(t *testing.T) {
+	h := newTestHandler()
+	h.DebugEcho = true
+	h.MaxFileSize = 10
+	h.UploadGuard = &UploadGuard{MinRate: 1024, BodyTimeout: caddy.Duration(time.Minute)}
+	h.UploadGuard.provision()
+
+	for i, tc := range []struct {
+		fields []testField
+		status int
+		field  string
+	}{
+		{
+			fields: []testField{{name: "title", value: "Hello"}, {name: "photo", value: "hello", fileName: "a.png", contentType: "image/png"}},
+			status: http.StatusOK,
+		},
+		{
+			fields: []testField{{name: "photo", value: "hello world", fileName: "a.png", contentType: "image/png"}},
+			status: http.StatusRequestEntityTooLarge,
+			field:  "photo",
+		},
+	} {
+		w, next, err := serveTest(t, h, newFormRequest(t, tc.fields...))
+		if err != nil {
+			t.Errorf("Test %d: unexpected error: %v", i, err)
+			continue
+		}
+		if next.called {
+			t.Errorf("Test %d: next handler called", i)
+		}
+		if w.Code != tc.status {
+			t.Errorf("Test %d: expected status %d, got %d", i, tc.status, w.Code)
+		}
+		var echo struct {
+			Body   json.RawMessage `json:"body"`
+			Error  *debugError     `json:"error"`
+			Limits debugLimits     `json:"limits"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &echo); err != nil {
+			t.Errorf("Test %d: decoding echo: %v", i, err)
+			continue
+		}
+		if echo.Limits.MaxFileSize != 10 || echo.Limits.UploadGuard == nil ||
+			echo.Limits.UploadGuard.MinRate != 1024 || echo.Limits.UploadGuard.BodyTimeout != "1m0s" {
+			t.Errorf("Test %d: unexpected limits: %+v", i, echo.Limits)
+		}
+		if tc.status == http.StatusOK {
+			if echo.Error != nil || len(echo.Body) == 0 {
+				t.Errorf("Test %d: expected a body and no error, got %s", i, w.Body)
+			}
+			continue
+		}
+		if echo.Error == nil || echo.Error.Status != tc.status || echo.Error.Field != tc.field || len(echo.Body) != 0 {
+			t.Errorf("Test %d: expected an error for %s, got %s", i, tc.field, w.Body)
+		}
+	}
+}
@@ -0,0 +1,106 @@
+// Copyright 2021 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package form2json
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+	"path/filepath"
+	"strings"
+	"unicode"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+// splitUploadPath returns the file name of the uploaded file fp and, for
+// directory uploads, its normalized relative path. If directory uploads
+// are disabled, any path information is discarded.
+func (h Handler) splitUploadPath(fp *formPart) (string, string, error) {
+	if !h.DirectoryUploads {
+		return filepath.Base(fp.FileName), "", nil
+	}
+	name := strings.ReplaceAll(fp.FileName, `\`, "/")
+	if !strings.Contains(name, "/") {
+		return name, "", nil
+	}
+	clean, err := normalizeUploadPath(name, h.MaxDirectoryDepth)
+	if err != nil {
+		return "", "", caddyhttp.Error(http.StatusBadRequest, fieldError{
+			Field:   fp.Name,
+			Message: err.Error(),
+		})
+	}
+	return path.Base(clean), clean, nil
+}
+
+// normalizeUploadPath validates the slash-separated relative path p of a
+// file in a directory upload, returning it without redundant elements.
+// Paths which are absolute, escape their root, contain control
+// characters or have more than maxDepth directories are rejected.
+func normalizeUploadPath(p string, maxDepth int) (string, error) {
+	if strings.HasPrefix(p, "/") || (len(p) >= 2 && p[1] == ':') {
+		return "", fmt.Errorf("file path must be relative: %q", p)
+	}
+	if strings.IndexFunc(p, unicode.IsControl) >= 0 {
+		return "", fmt.Errorf("file path contains control characters: %q", p)
+	}
+
+	var elems []string
+	for _, elem := range strings.Split(p, "/") {
+		switch elem {
+		case "", ".":
+			continue
+		case "..":
+			return "", fmt.Errorf("file path must not contain '..': %q", p)
+		}
+		elems = append(elems, elem)
+	}
+	if len(elems) == 0 {
+		return "", fmt.Errorf("empty file path")
+	}
+	if len(elems)-1 > maxDepth {
+		return "", fmt.Errorf("file path exceeds maximum depth of %d: %q", maxDepth, p)
+	}
+	return strings.Join(elems, "/"), nil
+}
+
+// dirTree is a directory in the tree of a directory upload, mapping
+// names to files (parts) and subdirectories.
+type dirTree map[string]interface{}
+
+// insert adds the file value at the relative path p.
+func (t dirTree) insert(p string, value interface{}) error {
+	elems := strings.Split(p, "/")
+	dir := t
+	for _, elem := range elems[:len(elems)-1] {
+		switch sub := dir[elem].(type) {
+		case nil:
+			next := make(dirTree)
+			dir[elem] = next
+			dir = next
+		case dirTree:
+			dir = sub
+		default:
+			return fmt.Errorf("path conflicts with a file: %q", p)
+		}
+	}
+	leaf := elems[len(elems)-1]
+	if _, exists := dir[leaf]; exists {
+		return fmt.Errorf("duplicate file path: %q", p)
+	}
+	dir[leaf] = value
+	return nil
+}
@@ -0,0 +1,135 @@
+// Copyright 2021 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package form2json
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+func TestNormalizeUploadPath(t *testing.T) {
+	for i, tc := range []struct {
+		input    string
+		expected string
+		err      bool
+	}{
+		{input: "photos/2026/a.jpg", expected: "photos/2026/a.jpg"},
+		{input: "photos//./2026/a.jpg", expected: "photos/2026/a.jpg"},
+		{input: "a/b/c/d.txt", expected: "a/b/c/d.txt"},
+		{input: "a/b/c/d/e.txt", err: true}, // too deep
+		{input: "/etc/passwd", err: true},
+		{input: "C:/Windows/a.txt", err: true},
+		{input: "photos/../../a.jpg", err: true},
+		{input: "photos/a\x00.jpg", err: true},
+		{input: "./", err: true},
+	} {
+		actual, err := normalizeUploadPath(tc.input, 3)
+		if tc.err {
+			if err == nil {
+				t.Errorf("Test %d: expected an error, got %q", i, actual)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test %d: unexpected error: %v", i, err)
+			continue
+		}
+		if actual != tc.expected {
+			t.Errorf("Test %d: expected %q, got %q", i, tc.expected, actual)
+		}
+	}
+}
+
+func TestDirTreeInsert(t *testing.T) {
+	tree := make(dirTree)
+	for i, tc := range []struct {
+		path string
+		err  bool
+	}{
+		{path: "photos/2026/a.jpg"},
+		{path: "photos/2026/b.jpg"},
+		{path: "photos/c.jpg"},
+		{path: "photos/2026/a.jpg", err: true},  // duplicate
+		{path: "photos/c.jpg/d.jpg", err: true}, // below a file
+		{path: "photos/2026", err: true},        // a directory
+	} {
+		err := tree.insert(tc.path, tc.path)
+		if (err != nil) != tc.err {
+			t.Errorf("Test %d: expected error %t, got %v", i, tc.err, err)
+		}
+	}
+	expected := `{"photos":{"2026":{"a.jpg":"photos/2026/a.jpg","b.jpg":"photos/2026/b.jpg"},"c.jpg":"photos/c.jpg"}}`
+	if actual, _ := json.Marshal(tree); string(actual) != expected {
+		t.Errorf("expected %s, got %s", expected, actual)
+	}
+}
+
+func TestDirectoryUploads(t *testing.T) {
+	files := []testField{
+		{name: "photos", value: "a", fileName: "photos/2026/a.jpg", contentType: "image/jpeg"},
+		{name: "photos", value: "b", fileName: "photos/b.jpg", contentType: "image/jpeg"},
+	}
+	for i, tc := range []struct {
+		directoryUploads bool
+		tree             bool
+		maxEntries       int
+		status           int
+		expected         string
+	}{
+		{
+			expected: `{"photos":[{"type":"file/base64","value":"YQ==","content_type":"image/jpeg","file_name":"a.jpg","size":1},` +
+				`{"type":"file/base64","value":"Yg==","content_type":"image/jpeg","file_name":"b.jpg","size":1}]}`,
+		},
+		{
+			directoryUploads: true,
+			expected: `{"photos":[{"type":"file/base64","value":"YQ==","content_type":"image/jpeg","file_name":"a.jpg","path":"photos/2026/a.jpg","size":1},` +
+				`{"type":"file/base64","value":"Yg==","content_type":"image/jpeg","file_name":"b.jpg","path":"photos/b.jpg","size":1}]}`,
+		},
+		{
+			directoryUploads: true,
+			tree:             true,
+			expected: `{"photos":{"photos":{"2026":{"a.jpg":{"type":"file/base64","value":"YQ==","content_type":"image/jpeg","file_name":"a.jpg","path":"photos/2026/a.jpg","size":1}},` +
+				`"b.jpg":{"type":"file/base64","value":"Yg==","content_type":"image/jpeg","file_name":"b.jpg","path":"photos/b.jpg","size":1}}}}`,
+		},
+		{
+			directoryUploads: true,
+			maxEntries:       1,
+			status:           http.StatusRequestEntityTooLarge,
+		},
+	} {
+		h := newTestHandler()
+		h.Mode = modeObject
+		h.DirectoryUploads = tc.directoryUploads
+		h.DirectoryTree = tc.tree
+		if tc.maxEntries > 0 {
+			h.MaxDirectoryEntries = tc.maxEntries
+		}
+		_, next, err := serveTest(t, h, newFormRequest(t, files...))
+		if tc.status != 0 {
+			if statusOf(err) != tc.status {
+				t.Errorf("Test %d: expected status %d, got %v", i, tc.status, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test %d: unexpected error: %v", i, err)
+			continue
+		}
+		if actual := string(next.body); actual != tc.expected+"\n" {
+			t.Errorf("Test %d: expected:\n%s\ngot:\n%s", i, tc.expected, actual)
+		}
+	}
+}
@@ -0,0 +1,191 @@
+// Copyright 2021 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package form2json
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+// encode writes the converted parts to buf in the configured mode and
+// encoding, returning the Content-Type and Content-Type-Class of the
+// result. If patches are enabled, original holds the values the form
+// was populated with. id is the ID of the submission.
+func (h Handler) encode(buf *bytes.Buffer, converted []part, original map[string]interface{}, id string) (string, string, error) {
+	contentType, class, err := h.encodeShaped(buf, converted, original, id)
+	if err != nil || !isJSONMediaType(contentType) || !h.CanonicalJSON {
+		return contentType, class, err
+	}
+	canon, err := canonicalJSON(buf.Bytes())
+	if err != nil {
+		return "", "", caddyhttp.Error(http.StatusInternalServerError, err)
+	}
+	buf.Reset()
+	buf.Write(canon)
+	return contentType, class, nil
+}
+
+// encodeShaped writes the converted parts to buf as described by encode,
+// but without canonicalizing any JSON.
+func (h Handler) encodeShaped(buf *bytes.Buffer, converted []part, original map[string]interface{}, id string) (string, string, error) {
+	if h.Patch == nil && h.Encoder == "" && h.Mode != modeObject {
+		// the submission is identified by the first part
+		parts := append([]part{{Type: "meta/submission_id", Value: id}}, converted...)
+		return "application/json", "caddy_post_json_v1", encodeParts(buf, parts)
+	}
+	if h.Encoder == encoderProtobuf {
+		return h.Protobuf.encode(buf, converted)
+	}
+	if h.Encoder == encoderRelated {
+		return h.encodeRelated(buf, converted)
+	}
+	if h.Encoder == encoderXML && h.Mode != modeObject {
+		return h.XML.encodeArray(buf, converted)
+	}
+	if h.Encoder == encoderJSONAPI {
+		return h.encodeJSONAPI(buf, converted)
+	}
+
+	// everything else is shaped from the object form of the parts
+	obj, err := h.buildObject(converted)
+	if err != nil {
+		return "", "", err
+	}
+	switch {
+	case h.Patch != nil:
+		return h.Patch.encode(buf, obj, original)
+	case h.Encoder == encoderJSONRPC:
+		return h.JSONRPC.encode(buf, obj, id)
+	case h.Encoder == encoderXML:
+		return h.XML.encodeObject(buf, obj)
+	}
+	return "application/json", "caddy_post_json_object_v1", encodeObject(buf, obj)
+}
+
+// encodeParts writes the converted parts to buf as a JSON array using
+// the part writer, which avoids reflection and writes file contents
+// directly into buf.
+func encodeParts(buf *bytes.Buffer, converted []part) error {
+	buf.WriteByte('[')
+	for i, p := range converted {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		if err := writePart(buf, p); err != nil {
+			return caddyhttp.Error(http.StatusInternalServerError, err)
+		}
+	}
+	buf.WriteString("]\n")
+	return nil
+}
+
+// encodeObject writes obj, the object form of the parts, to buf with
+// the part writer, followed by a newline.
+func encodeObject(buf *bytes.Buffer, obj map[string]interface{}) error {
+	if err := writeObject(buf, obj); err != nil {
+		return caddyhttp.Error(http.StatusInternalServerError, err)
+	}
+	buf.WriteByte('\n')
+	return nil
+}
+
+// encodeJSON writes v to buf as JSON.
+func encodeJSON(buf *bytes.Buffer, v interface{}) error {
+	if err := json.NewEncoder(buf).Encode(v); err != nil {
+		return caddyhttp.Error(http.StatusInternalServerError, err)
+	}
+	return nil
+}
+
+// takeString removes the named field from obj, returning its value if
+// it is a string (or the first of several strings).
+func takeString(obj map[string]interface{}, name string) string {
+	val, ok := obj[name]
+	if !ok {
+		return ""
+	}
+	delete(obj, name)
+	if vals, ok := val.([]interface{}); ok && len(vals) > 0 {
+		val = vals[0]
+	}
+	s, _ := val.(string)
+	return s
+}
+
+// buildObject assembles converted parts into an object keyed by field
+// name. Fields occurring more than once map to arrays of their values.
+func (h Handler) buildObject(converted []part) (map[string]interface{}, error) {
+	obj := make(map[string]interface{})
+	for _, p := range converted {
+		val := objectValue(p)
+
+		if h.DirectoryTree && p.Path != "" {
+			tree, ok := obj[p.Name].(dirTree)
+			if !ok {
+				if _, exists := obj[p.Name]; exists {
+					return nil, caddyhttp.Error(http.StatusBadRequest, fieldError{
+						Field:   p.Name,
+						Message: "directory upload mixed with other values",
+					})
+				}
+				tree = make(dirTree)
+				obj[p.Name] = tree
+			}
+			if err := tree.insert(p.Path, val); err != nil {
+				return nil, caddyhttp.Error(http.StatusBadRequest, fieldError{
+					Field:   p.Name,
+					Message: err.Error(),
+				})
+			}
+			continue
+		}
+
+		switch existing := obj[p.Name].(type) {
+		case nil:
+			obj[p.Name] = val
+		case []interface{}:
+			obj[p.Name] = append(existing, val)
+		case dirTree:
+			return nil, caddyhttp.Error(http.StatusBadRequest, fieldError{
+				Field:   p.Name,
+				Message: "directory upload mixed with other values",
+			})
+		default:
+			obj[p.Name] = []interface{}{existing, val}
+		}
+	}
+	return obj, nil
+}
+
+// objectValue returns the value representing p in object mode: the
+// value itself for fields, the objects of its rows for groups, or the
+// part without its name for files.
+func objectValue(p part) interface{} {
+	switch {
+	case strings.HasPrefix(p.Type, "file"):
+		p.Name = ""
+		return p
+	case p.rows != nil:
+		return p.rowObjects()
+	case p.RawValue != nil:
+		return p.RawValue
+	default:
+		return p.Value
+	}
+}
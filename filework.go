@@ -0,0 +1,111 @@
+// Copyright 2021 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package form2json
+
+import (
+	"context"
+	"sync"
+)
+
+// fileJob is a file part awaiting processing.
+type fileJob struct {
+	index int // index of the part in the converted payload
+	fp    *formPart
+}
+
+// processFiles fills in the contents of the converted file parts
+// described by jobs, using up to h.FileWorkers goroutines. Each job
+// writes only to its own part, so the order of parts is unaffected.
+// The first error cancels the remaining jobs and is returned, unless
+// the request was canceled, in which case its context's error is.
+func (h Handler) processFiles(ctx context.Context, converted []part, jobs []fileJob) error {
+	if h.FileWorkers <= 1 || len(jobs) <= 1 {
+		for _, job := range jobs {
+			if err := h.processFileJob(ctx, converted, job); err != nil {
+				if ctx.Err() != nil {
+					return ctx.Err()
+				}
+				return err
+			}
+		}
+		return nil
+	}
+
+	reqCtx := ctx
+	ctx, cancel := context.WithCancel(reqCtx)
+	defer cancel()
+
+	var (
+		wg       sync.WaitGroup
+		once     sync.Once
+		firstErr error
+	)
+	work := make(chan fileJob)
+	for i := 0; i < h.FileWorkers && i < len(jobs); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range work {
+				if ctx.Err() != nil {
+					continue
+				}
+				if err := h.processFileJob(ctx, converted, job); err != nil {
+					once.Do(func() {
+						firstErr = err
+						cancel()
+					})
+				}
+			}
+		}()
+	}
+
+feed:
+	for _, job := range jobs {
+		select {
+		case work <- job:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(work)
+	wg.Wait()
+
+	// errors caused by the request itself being canceled are reported
+	// as such, rather than as failures of whichever job noticed first
+	if err := reqCtx.Err(); err != nil {
+		return err
+	}
+	return firstErr
+}
+
+// processFileJob processes a single job once a slot is available in
+// the handler-wide limit and the shared worker pool, if any.
+func (h Handler) processFileJob(ctx context.Context, converted []part, job fileJob) error {
+	if h.fileSem != nil {
+		select {
+		case h.fileSem <- struct{}{}:
+			defer func() { <-h.fileSem }()
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	if h.filePool != nil {
+		if err := h.filePool.acquire(ctx); err != nil {
+			return err
+		}
+		defer h.filePool.release()
+	}
+	return h.processFile(ctx, &converted[job.index], job.fp)
+}
@@ -0,0 +1,139 @@
+// Copyright 2021 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package form2json
+
+import (
+	"context"
+	"encoding/base64"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+func TestProcessFilesOrder(t *testing.T) {
+	var fields []testField
+	for i := 0; i < 20; i++ {
+		name := "file" + strconv.Itoa(i)
+		fields = append(fields, testField{name: name, value: strings.Repeat(name, 1000-i*40), fileName: name + ".txt"})
+		fields = append(fields, testField{name: "field" + strconv.Itoa(i), value: strconv.Itoa(i)})
+	}
+
+	for _, workers := range []int{1, 4, 32} {
+		h := newTestHandler()
+		h.FileWorkers = workers
+		form, err := parseForm(newFormRequest(t, fields...), 4096, nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		converted, err := h.convert(context.Background(), form, true, true)
+		if err != nil {
+			t.Fatalf("%d workers: unexpected error: %v", workers, err)
+		}
+		if len(converted) != len(fields) {
+			t.Fatalf("%d workers: expected %d parts, got %d", workers, len(fields), len(converted))
+		}
+		for i, p := range converted {
+			if p.Name != fields[i].name {
+				t.Errorf("%d workers: expected part %d to be %s, got %s", workers, i, fields[i].name, p.Name)
+			}
+			if fields[i].fileName == "" {
+				continue
+			}
+			// contents are streamed into the output, not held in the part
+			if p.Type != "file/base64" || p.Value != "" || p.src == nil {
+				t.Errorf("%d workers: expected %s to be streamed, got %+v", workers, p.Name, p)
+				continue
+			}
+			value, err := p.fileValue()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if expected := base64.StdEncoding.EncodeToString([]byte(fields[i].value)); value != expected {
+				t.Errorf("%d workers: %s has the wrong contents", workers, p.Name)
+			}
+		}
+		form.RemoveAll()
+	}
+}
+
+func TestProcessFilesErrors(t *testing.T) {
+	// the media service fails files named bad.txt, and holds the others
+	// until their uploads are canceled
+	media := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		if strings.Contains(string(body), `filename="bad.txt"`) {
+			http.Error(w, "failed", http.StatusInternalServerError)
+			return
+		}
+		select {
+		case <-r.Context().Done():
+		case <-time.After(10 * time.Second):
+		}
+	}))
+	defer media.Close()
+
+	for i, tc := range []struct {
+		workers int
+		files   []string
+		cancel  bool
+		status  int
+	}{
+		{workers: 1, files: []string{"bad.txt", "a.txt"}, status: http.StatusBadGateway},
+		{workers: 4, files: []string{"a.txt", "b.txt", "bad.txt", "c.txt"}, status: http.StatusBadGateway},
+		{workers: 2, files: []string{"a.txt", "bad.txt", "c.txt", "d.txt"}, status: http.StatusBadGateway},
+		{workers: 4, files: []string{"a.txt", "b.txt"}, cancel: true},
+		{workers: 1, files: []string{"a.txt", "b.txt"}, cancel: true},
+	} {
+		h := newTestHandler()
+		h.FileWorkers = tc.workers
+		h.Media = &Media{URL: media.URL}
+		if err := h.Media.provision(caddy.NewReplacer()); err != nil {
+			t.Fatal(err)
+		}
+		var fields []testField
+		for _, name := range tc.files {
+			fields = append(fields, testField{name: "file", value: "x", fileName: name})
+		}
+		form, err := parseForm(newFormRequest(t, fields...), defaultMemLimit, nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		if tc.cancel {
+			time.AfterFunc(50*time.Millisecond, cancel)
+		}
+		start := time.Now()
+		_, err = h.convert(ctx, form, true, true)
+		cancel()
+		if elapsed := time.Since(start); elapsed > 5*time.Second {
+			t.Errorf("Test %d: expected remaining jobs to be canceled, took %s", i, elapsed)
+		}
+		if tc.cancel {
+			if err != context.Canceled {
+				t.Errorf("Test %d: expected %v, got %v", i, context.Canceled, err)
+			}
+		} else if statusOf(err) != tc.status {
+			t.Errorf("Test %d: expected status %d, got %v", i, tc.status, err)
+		}
+		form.RemoveAll()
+	}
+}
@@ -0,0 +1,296 @@
+// Copyright 2021 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package form2json
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// form is a parsed form payload. Unlike multipart.Form, it preserves
+// the order of parts and the headers of every part, not just files.
+type form struct {
+	parts []*formPart
+}
+
+// formPart is a single field or file of a form.
+type formPart struct {
+	Name string
+
+	// FileName is the file name as sent by the client, which
+	// may include a path (unlike multipart.Part.FileName).
+	FileName string
+
+	Header textproto.MIMEHeader
+	Size   int64
+
+	data    []byte // contents, if held in memory
+	tmpfile string // path to contents, if spooled to disk
+}
+
+// isFile returns true if the part is a file upload.
+func (fp *formPart) isFile() bool {
+	return fp.FileName != ""
+}
+
+// contentType returns the part's declared Content-Type, if any.
+func (fp *formPart) contentType() string {
+	return fp.Header.Get("Content-Type")
+}
+
+// value returns the contents of a part held in memory as a string.
+func (fp *formPart) value() string {
+	return string(fp.data)
+}
+
+// Open opens the part's contents for reading.
+func (fp *formPart) Open() (io.ReadCloser, error) {
+	if fp.tmpfile != "" {
+		return os.Open(fp.tmpfile)
+	}
+	return ioutil.NopCloser(bytes.NewReader(fp.data)), nil
+}
+
+// contents returns the part's contents.
+func (fp *formPart) contents() ([]byte, error) {
+	if fp.tmpfile != "" {
+		return ioutil.ReadFile(fp.tmpfile)
+	}
+	return fp.data, nil
+}
+
+// RemoveAll removes any temporary files associated with the form. It
+// may be called more than once.
+func (f *form) RemoveAll() error {
+	var err error
+	for _, fp := range f.parts {
+		if fp.tmpfile == "" {
+			continue
+		}
+		if e := os.Remove(fp.tmpfile); e != nil && !os.IsNotExist(e) {
+			if err == nil {
+				err = e
+			}
+			continue
+		}
+		fp.tmpfile = ""
+	}
+	return err
+}
+
+// remove removes all parts with the given name from the form,
+// returning true if there were any.
+func (f *form) remove(name string) bool {
+	kept := f.parts[:0]
+	for _, fp := range f.parts {
+		if fp.Name != name {
+			kept = append(kept, fp)
+		}
+	}
+	removed := len(kept) != len(f.parts)
+	f.parts = kept
+	return removed
+}
+
+// parseForm reads the url-encoded or multipart form payload of r. Up
+// to memLimit bytes of file contents are kept in memory; the rest are
+// written to temporary files, which the caller must remove with
+// RemoveAll, even if an error is returned. Multipart payloads are read
+// with mp if it is not nil, and with mime/multipart otherwise. If uw is
+// not nil, it is notified of the progress of the upload.
+func parseForm(r *http.Request, memLimit int64, mp *MultipartParser, uw *uploadWatch) (*form, error) {
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+		src, err := newPartSource(r, mp)
+		if err != nil {
+			return nil, err
+		}
+		return parseMultipart(src, memLimit, uw)
+	}
+	uw.headersReceived()
+	return parseURLEncoded(r)
+}
+
+// parseURLEncoded reads the application/x-www-form-urlencoded payload
+// of r, preserving the order of fields.
+func parseURLEncoded(r *http.Request) (*form, error) {
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxValueBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(body) > maxValueBytes {
+		return nil, fmt.Errorf("form payload too large")
+	}
+
+	f := new(form)
+	for _, pair := range strings.Split(string(body), "&") {
+		if pair == "" {
+			continue
+		}
+		kv := strings.SplitN(pair, "=", 2)
+		name, err := url.QueryUnescape(kv[0])
+		if err != nil {
+			return nil, err
+		}
+		var value string
+		if len(kv) == 2 {
+			value, err = url.QueryUnescape(kv[1])
+			if err != nil {
+				return nil, err
+			}
+		}
+		f.parts = append(f.parts, &formPart{
+			Name:   name,
+			Header: make(textproto.MIMEHeader),
+			Size:   int64(len(value)),
+			data:   []byte(value),
+		})
+	}
+	return f, nil
+}
+
+// partSource returns the parts of a multipart payload in turn, with
+// readers for their bodies, and io.EOF after the last part. Parts
+// without a form field name are skipped.
+type partSource interface {
+	nextPart() (*formPart, io.Reader, error)
+}
+
+// newPartSource returns a partSource for the multipart payload of r.
+func newPartSource(r *http.Request, mp *MultipartParser) (partSource, error) {
+	if mp != nil {
+		return mp.newReader(r.Body, r.Header.Get("Content-Type"))
+	}
+	mr, err := r.MultipartReader()
+	if err != nil {
+		return nil, err
+	}
+	return stdPartSource{mr}, nil
+}
+
+// stdPartSource reads parts with mime/multipart.
+type stdPartSource struct {
+	mr *multipart.Reader
+}
+
+func (s stdPartSource) nextPart() (*formPart, io.Reader, error) {
+	for {
+		p, err := s.mr.NextPart()
+		if err != nil {
+			return nil, nil, err
+		}
+		name := p.FormName()
+		if name == "" {
+			p.Close()
+			continue
+		}
+		return &formPart{
+			Name:     name,
+			FileName: rawFileName(p),
+			Header:   p.Header,
+		}, p, nil
+	}
+}
+
+// parseMultipart reads the parts of src in the same way as
+// multipart.Reader.ReadForm, but keeps every part's headers.
+func parseMultipart(src partSource, memLimit int64, uw *uploadWatch) (*form, error) {
+	f := new(form)
+	valueBytes := int64(maxValueBytes)
+	for {
+		fp, p, err := src.nextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return f, err
+		}
+		uw.partStarted(fp.Name)
+
+		if !fp.isFile() {
+			// values are always held in memory, up to a sane limit
+			var buf bytes.Buffer
+			n, err := io.CopyN(&buf, p, valueBytes+1)
+			if err != nil && err != io.EOF {
+				return f, err
+			}
+			valueBytes -= n
+			if valueBytes < 0 {
+				return f, fmt.Errorf("form values too large")
+			}
+			fp.data = buf.Bytes()
+			fp.Size = n
+			f.parts = append(f.parts, fp)
+			uw.partDone()
+			continue
+		}
+
+		// file contents are held in memory up to memLimit, then spooled
+		var buf bytes.Buffer
+		n, err := io.CopyN(&buf, p, memLimit+1)
+		if err != nil && err != io.EOF {
+			return f, err
+		}
+		if n > memLimit {
+			tmp, err := ioutil.TempFile("", "multipart-")
+			if err != nil {
+				return f, err
+			}
+			fp.tmpfile = tmp.Name()
+			f.parts = append(f.parts, fp)
+			size, err := io.Copy(tmp, io.MultiReader(&buf, p))
+			if cerr := tmp.Close(); err == nil {
+				err = cerr
+			}
+			if err != nil {
+				return f, err
+			}
+			fp.Size = size
+			uw.partDone()
+			continue
+		}
+		memLimit -= n
+		fp.data = buf.Bytes()
+		fp.Size = n
+		f.parts = append(f.parts, fp)
+		uw.partDone()
+	}
+	return f, nil
+}
+
+// rawFileName returns the file name of p without discarding any
+// directory path information.
+func rawFileName(p *multipart.Part) string {
+	if p.FileName() == "" {
+		return ""
+	}
+	_, params, err := mime.ParseMediaType(p.Header.Get("Content-Disposition"))
+	if err != nil || params["filename"] == "" {
+		return p.FileName()
+	}
+	return params["filename"]
+}
+
+// maxValueBytes is the maximum total size of non-file form values,
+// matching the limit used by net/http.
+const maxValueBytes = 10 << 20
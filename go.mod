@@ -2,4 +2,14 @@ module github.com/appcove/caddy-post2json
 
 go 1.15
 
-require github.com/caddyserver/caddy/v2 v2.3.1-0.20210209211504-5ef76ff3e6e7
+require (
+	github.com/caddyserver/caddy/v2 v2.3.1-0.20210209211504-5ef76ff3e6e7
+	github.com/klauspost/compress v1.11.12
+	github.com/nats-io/nats-server/v2 v2.2.6
+	github.com/nats-io/nats.go v1.11.0
+	github.com/prometheus/client_golang v1.9.0
+	github.com/streadway/amqp v1.0.0
+	go.uber.org/zap v1.16.0
+	google.golang.org/grpc v1.27.1
+	google.golang.org/protobuf v1.24.0
+)
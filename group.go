@@ -0,0 +1,190 @@
+// Copyright 2021 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package form2json
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+// GroupRule collects fields whose names match a pattern into an array
+// of objects. For example, the pattern `^(?P<key>\w+)_(?P<index>\d+)$`
+// collects name_1, email_1, name_2 and email_2 into
+// [{"name": ..., "email": ...}, {"name": ..., "email": ...}].
+type GroupRule struct {
+	// The name of the field the groups are collected into.
+	Name string `json:"name"`
+
+	// A regular expression matched against field names. It must have
+	// the named captures "key", the field's name within its group, and
+	// "index", which identifies the group. Groups are ordered by index,
+	// numerically if all indexes are numbers.
+	Pattern string `json:"pattern"`
+
+	// The maximum number of groups. Default: 100
+	MaxGroups int `json:"max_groups,omitempty"`
+
+	re       *regexp.Regexp
+	keyIdx   int
+	indexIdx int
+}
+
+func (rule *GroupRule) provision() error {
+	if rule.Name == "" {
+		return fmt.Errorf("name is required")
+	}
+	re, err := regexp.Compile(rule.Pattern)
+	if err != nil {
+		return fmt.Errorf("compiling pattern: %v", err)
+	}
+	rule.re = re
+	rule.keyIdx = re.SubexpIndex("key")
+	rule.indexIdx = re.SubexpIndex("index")
+	if rule.keyIdx < 0 || rule.indexIdx < 0 {
+		return fmt.Errorf("pattern must have named captures 'key' and 'index'")
+	}
+	if rule.MaxGroups <= 0 {
+		rule.MaxGroups = defaultMaxGroups
+	}
+	return nil
+}
+
+// partGroup is one group of parts collected by a GroupRule. The parts
+// are named by their key within the group.
+type partGroup struct {
+	index string
+	parts []part
+	obj   map[string]interface{} // object form of parts
+}
+
+// applyGroups replaces the parts matching each group rule with a single
+// group part, located where the first matching part was.
+func (h Handler) applyGroups(converted []part) ([]part, error) {
+	for _, rule := range h.Groups {
+		var err error
+		converted, err = h.applyGroup(rule, converted)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return converted, nil
+}
+
+func (h Handler) applyGroup(rule *GroupRule, converted []part) ([]part, error) {
+	var rows []partGroup
+	byIndex := make(map[string]int)
+	var out []part
+	first := -1
+
+	for _, p := range converted {
+		m := rule.re.FindStringSubmatch(p.Name)
+		if m == nil || p.rows != nil {
+			out = append(out, p)
+			continue
+		}
+		if first < 0 {
+			first = len(out)
+		}
+		index := m[rule.indexIdx]
+		i, ok := byIndex[index]
+		if !ok {
+			if len(rows) >= rule.MaxGroups {
+				return nil, caddyhttp.Error(http.StatusRequestEntityTooLarge, fieldError{
+					Field:   rule.Name,
+					Message: "too many groups, maximum is " + strconv.Itoa(rule.MaxGroups),
+				})
+			}
+			i = len(rows)
+			byIndex[index] = i
+			rows = append(rows, partGroup{index: index})
+		}
+		p.Name = m[rule.keyIdx]
+		rows[i].parts = append(rows[i].parts, p)
+	}
+	if first < 0 {
+		return converted, nil
+	}
+
+	sortGroups(rows)
+
+	group, err := h.groupPart(rule.Name, rows)
+	if err != nil {
+		return nil, err
+	}
+	out = append(out[:first], append([]part{group}, out[first:]...)...)
+	return out, nil
+}
+
+// groupPart returns the group part with the given name holding rows.
+func (h Handler) groupPart(name string, rows []partGroup) (part, error) {
+	for i := range rows {
+		obj, err := h.buildObject(rows[i].parts)
+		if err != nil {
+			return part{}, err
+		}
+		rows[i].obj = obj
+	}
+	// the rows are only written out, files and all, when the payload is
+	// encoded
+	return part{Name: name, Type: "group", rows: rows}, nil
+}
+
+// rowObjects returns the object form of each row of the group part p.
+func (p part) rowObjects() []interface{} {
+	objects := make([]interface{}, len(p.rows))
+	for i, row := range p.rows {
+		objects[i] = row.obj
+	}
+	return objects
+}
+
+// sortGroups orders groups by index, numerically if every index is
+// an integer and lexically otherwise.
+func sortGroups(rows []partGroup) {
+	numeric := true
+	nums := make([]int64, len(rows))
+	for i, row := range rows {
+		n, err := strconv.ParseInt(row.index, 10, 64)
+		if err != nil {
+			numeric = false
+			break
+		}
+		nums[i] = n
+	}
+	if numeric {
+		sort.Sort(byNumericIndex{rows, nums})
+		return
+	}
+	sort.SliceStable(rows, func(i, j int) bool { return rows[i].index < rows[j].index })
+}
+
+type byNumericIndex struct {
+	rows []partGroup
+	nums []int64
+}
+
+func (s byNumericIndex) Len() int           { return len(s.rows) }
+func (s byNumericIndex) Less(i, j int) bool { return s.nums[i] < s.nums[j] }
+func (s byNumericIndex) Swap(i, j int) {
+	s.rows[i], s.rows[j] = s.rows[j], s.rows[i]
+	s.nums[i], s.nums[j] = s.nums[j], s.nums[i]
+}
+
+const defaultMaxGroups = 100
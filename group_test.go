@@ -0,0 +1,145 @@
+// Copyright 2021 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package form2json
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestGroupRuleProvision(t *testing.T) {
+	for i, tc := range []struct {
+		rule      GroupRule
+		expectErr bool
+	}{
+		{rule: GroupRule{Name: "people", Pattern: `^(?P<key>\w+)_(?P<index>\d+)$`}},
+		{rule: GroupRule{Pattern: `^(?P<key>\w+)_(?P<index>\d+)$`}, expectErr: true},
+		{rule: GroupRule{Name: "people", Pattern: `^(?P<key>\w+`}, expectErr: true},
+		{rule: GroupRule{Name: "people", Pattern: `^(?P<key>\w+)_(\d+)$`}, expectErr: true},
+	} {
+		err := tc.rule.provision()
+		if tc.expectErr {
+			if err == nil {
+				t.Errorf("Test %d: expected an error", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test %d: unexpected error: %v", i, err)
+			continue
+		}
+		if tc.rule.MaxGroups != defaultMaxGroups {
+			t.Errorf("Test %d: expected max groups %d, got %d", i, defaultMaxGroups, tc.rule.MaxGroups)
+		}
+	}
+}
+
+func TestSortGroups(t *testing.T) {
+	for i, tc := range []struct {
+		indexes  []string
+		expected []string
+	}{
+		{indexes: []string{"10", "2", "1"}, expected: []string{"1", "2", "10"}},
+		{indexes: []string{"-1", "0", "-3"}, expected: []string{"-3", "-1", "0"}},
+		{indexes: []string{"b", "10", "a", "2"}, expected: []string{"10", "2", "a", "b"}},
+		{indexes: []string{"x"}, expected: []string{"x"}},
+		{},
+	} {
+		rows := make([]partGroup, len(tc.indexes))
+		for j, index := range tc.indexes {
+			rows[j].index = index
+		}
+		sortGroups(rows)
+		for j, row := range rows {
+			if row.index != tc.expected[j] {
+				t.Errorf("Test %d: expected index %s at %d, got %s", i, tc.expected[j], j, row.index)
+			}
+		}
+	}
+}
+
+func TestGroups(t *testing.T) {
+	for i, tc := range []struct {
+		fields    []testField
+		maxGroups int
+		status    int
+		expected  string
+	}{
+		{
+			fields: []testField{
+				{name: "title", value: "team"},
+				{name: "name_2", value: "bob"},
+				{name: "email_2", value: "bob@example.com"},
+				{name: "name_10", value: "carol"},
+				{name: "name_1", value: "alice"},
+				{name: "notes", value: "none"},
+			},
+			expected: `{"notes":"none","people":[{"name":"alice"},{"email":"bob@example.com","name":"bob"},{"name":"carol"}],"title":"team"}`,
+		},
+		{
+			fields: []testField{
+				{name: "title", value: "team"},
+			},
+			expected: `{"title":"team"}`,
+		},
+		{
+			fields: []testField{
+				{name: "name_1", value: "alice"},
+				{name: "name_1", value: "alicia"},
+			},
+			expected: `{"people":[{"name":["alice","alicia"]}]}`,
+		},
+		{
+			fields: []testField{
+				{name: "name_1", value: "alice"},
+				{name: "name_2", value: "bob"},
+				{name: "email_2", value: "bob@example.com"},
+			},
+			maxGroups: 2,
+			expected:  `{"people":[{"name":"alice"},{"email":"bob@example.com","name":"bob"}]}`,
+		},
+		{
+			fields: []testField{
+				{name: "name_1", value: "alice"},
+				{name: "name_2", value: "bob"},
+				{name: "name_3", value: "carol"},
+			},
+			maxGroups: 2,
+			status:    http.StatusRequestEntityTooLarge,
+		},
+	} {
+		h := newTestHandler()
+		h.Mode = modeObject
+		rule := &GroupRule{Name: "people", Pattern: `^(?P<key>[a-z]+)_(?P<index>\d+)$`, MaxGroups: tc.maxGroups}
+		if err := rule.provision(); err != nil {
+			t.Fatal(err)
+		}
+		h.Groups = []*GroupRule{rule}
+		_, next, err := serveTest(t, h, newFormRequest(t, tc.fields...))
+		if tc.status != 0 {
+			if statusOf(err) != tc.status {
+				t.Errorf("Test %d: expected status %d, got %v", i, tc.status, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test %d: unexpected error: %v", i, err)
+			continue
+		}
+		if actual := string(next.body); actual != tc.expected+"\n" {
+			t.Errorf("Test %d: expected:\n%s\ngot:\n%s", i, tc.expected, actual)
+		}
+	}
+}
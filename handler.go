@@ -16,18 +16,22 @@ package form2json
 
 import (
 	"bytes"
+	"context"
 	"encoding/base64"
 	"encoding/json"
+	"fmt"
 	"io"
 	"io/ioutil"
-	"mime/multipart"
+	"mime"
 	"net/http"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/caddyserver/caddy/v2"
 	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
 )
 
 func init() {
@@ -40,6 +44,197 @@ type Handler struct {
 	// Any files larger than this limit will be written to disk temporarily
 	// while processing requests. Default: 2 MB
 	MemoryLimit int64 `json:"memory_limit,omitempty"`
+
+	// If true, respond to the client with the converted payload, the
+	// headers that would have been set, and processing details instead
+	// of passing the request to the next handler. Intended for debugging
+	// forms; do not enable on production routes.
+	DebugEcho bool `json:"debug_echo,omitempty"`
+
+	// Secret used to verify signed debug echo requests. If set, requests
+	// carrying a valid Form2json-Debug header are echoed even if
+	// DebugEcho is false. The token is "<unix expiry>.<hex signature>",
+	// where the signature is HMAC-SHA256 of the expiry using this key.
+	// Placeholders (e.g. {env.FORM2JSON_DEBUG_KEY}) are supported.
+	DebugEchoKey string `json:"debug_echo_key,omitempty"`
+
+	// The maximum lifetime of signed debug tokens: tokens expiring
+	// later than this from the time of the request are rejected, so
+	// that leaked tokens cannot be used indefinitely. Default: 1h
+	DebugEchoMaxAge caddy.Duration `json:"debug_echo_max_age,omitempty"`
+
+	// A request header which, if present with a non-empty value, marks
+	// the request as validate-only. Requests with the standard
+	// "Prefer: handling=validate-only" header are always validate-only.
+	// Validate-only requests are parsed and validated, and the result is
+	// returned to the client as JSON without calling the next handler.
+	ValidateOnlyHeader string `json:"validate_only_header,omitempty"`
+
+	// A form field which, if present, marks the request as validate-only.
+	// The field is not included in the converted payload.
+	ValidateOnlyField string `json:"validate_only_field,omitempty"`
+
+	// If true, file contents are encoded for validate-only requests as
+	// they would be normally. By default only file metadata is reported,
+	// which is much cheaper for large uploads.
+	ValidateFiles bool `json:"validate_files,omitempty"`
+
+	// How file contents are encoded in JSON: "base64" (default), or
+	// "gzip+base64" or "zstd+base64" to compress them before encoding.
+	// Compressed files have the type "file/<encoding>" and report their
+	// compressed size; files are only compressed if they are at least
+	// CompressMinSize bytes and compression makes them smaller, and are
+	// otherwise encoded as plain base64. Compression cannot be combined
+	// with the protobuf encoder.
+	FileEncoding string `json:"file_encoding,omitempty"`
+
+	// The minimum size in bytes of files to compress. Default: 1024
+	CompressMinSize int64 `json:"compress_min_size,omitempty"`
+
+	// The maximum size in bytes of any single file. Default: no limit
+	MaxFileSize int64 `json:"max_file_size,omitempty"`
+
+	// If set, only files with these media types are accepted. A type
+	// may end with "/*" to match all of its subtypes, e.g. "image/*".
+	FileTypes []string `json:"file_types,omitempty"`
+
+	// Text fields which may contain RFC 2397 data URLs, as posted by
+	// signature pads and canvas-based image editors. Data URLs in these
+	// fields are decoded, checked against the same file policies as
+	// uploaded files, and emitted as file parts with a filename derived
+	// from the field name and media type.
+	DataURLFields []string `json:"data_url_fields,omitempty"`
+
+	// If true, non-file parts declaring a JSON Content-Type (such as
+	// Blobs appended to a FormData by fetch clients) are embedded as
+	// JSON values with type "field/json" rather than as strings. The
+	// Content-Type of non-file parts is reported either way.
+	EmbedJSON bool `json:"embed_json,omitempty"`
+
+	// The shape of the converted payload. Default: "array", a list of
+	// parts in the order they were received. "object" produces a JSON
+	// object keyed by field name, where each field maps to its value
+	// (or to an array of values if it occurs more than once); file
+	// fields map to their part objects.
+	Mode string `json:"mode,omitempty"`
+
+	// The encoding of the converted payload. Default: plain JSON in the
+	// configured mode. "jsonapi" produces a JSON:API resource document
+	// and "jsonrpc" a JSON-RPC 2.0 request, both shaped from the object
+	// form of the payload. "protobuf" produces a binary protobuf message.
+	// "xml" produces an XML document in the configured mode. "related"
+	// produces a multipart/related payload: a JSON root part in the
+	// configured mode, in which the value of each file is a "cid:"
+	// reference to one of the raw binary parts that follow it.
+	Encoder string `json:"encoder,omitempty"`
+
+	// If true, JSON payloads are written in the canonical form defined
+	// by RFC 8785 (JSON Canonicalization Scheme), so that they can be
+	// reliably hashed and signed downstream: object keys are sorted,
+	// numbers and strings are formatted canonically, and there is no
+	// insignificant whitespace.
+	CanonicalJSON bool `json:"canonical_json,omitempty"`
+
+	// Configures the "jsonapi" encoder.
+	JSONAPI *JSONAPI `json:"jsonapi,omitempty"`
+
+	// Configures the "jsonrpc" encoder.
+	JSONRPC *JSONRPC `json:"jsonrpc,omitempty"`
+
+	// Configures the "protobuf" encoder, which maps the payload onto a
+	// protobuf message, and can optionally call a gRPC service with it.
+	Protobuf *Protobuf `json:"protobuf,omitempty"`
+
+	// Configures the "xml" encoder.
+	XML *XML `json:"xml,omitempty"`
+
+	// If true, accept directory uploads (<input type=file webkitdirectory>)
+	// whose file names contain relative paths. Paths are validated and
+	// normalized and emitted as the "path" of each file part, while the
+	// file name is reduced to its last element.
+	DirectoryUploads bool `json:"directory_uploads,omitempty"`
+
+	// In object mode, if true, files of a directory upload are nested
+	// under their field as a tree of directories keyed by name.
+	DirectoryTree bool `json:"directory_tree,omitempty"`
+
+	// The maximum number of directories in a directory upload path.
+	// Default: 16
+	MaxDirectoryDepth int `json:"max_directory_depth,omitempty"`
+
+	// The maximum number of files with directory paths in a single
+	// request. Default: 1000
+	MaxDirectoryEntries int `json:"max_directory_entries,omitempty"`
+
+	// Rules which collect suffixed fields, as used by legacy forms
+	// (e.g. name_1, email_1, name_2, email_2), into arrays of objects.
+	Groups []*GroupRule `json:"groups,omitempty"`
+
+	// If set, HTML forms (which can only POST) may override the method
+	// of the request passed to the next handler.
+	MethodOverride *MethodOverride `json:"method_override,omitempty"`
+
+	// If set, edit forms are converted into patches containing only
+	// the fields which changed from a signed snapshot of the original
+	// values embedded in the form.
+	Patch *Patch `json:"patch,omitempty"`
+
+	// If set, the rows of a group are split into separate requests,
+	// and their results aggregated into a single response.
+	Batch *Batch `json:"batch,omitempty"`
+
+	// If set, uploaded files are sent to a media service before the
+	// request is passed on, and file parts carry the service's JSON
+	// response (such as IDs or URLs) instead of their contents.
+	Media *Media `json:"media,omitempty"`
+
+	// The maximum number of files of a single request which are
+	// processed (compressed, encoded, or uploaded to the media service)
+	// concurrently. The order of parts is preserved, and processing
+	// stops at the first error. Default: 1
+	FileWorkers int `json:"file_workers,omitempty"`
+
+	// The maximum number of files processed concurrently across all
+	// requests to this handler. Default: no limit
+	MaxFileWorkers int `json:"max_file_workers,omitempty"`
+
+	// If set, multipart payloads are read with a parser of configurable
+	// strictness rather than Go's mime/multipart reader.
+	Multipart *MultipartParser `json:"multipart,omitempty"`
+
+	// If set, slow or stalled uploads are aborted.
+	UploadGuard *UploadGuard `json:"upload_guard,omitempty"`
+
+	// The name of a worker pool of the form2json app which limits the
+	// number of files processed concurrently across all handlers using
+	// it, in addition to FileWorkers and MaxFileWorkers.
+	FilePool string `json:"file_pool,omitempty"`
+
+	// If set, converted payloads are published to a sink of the
+	// form2json app, such as a message broker.
+	Publish *Publish `json:"publish,omitempty"`
+
+	// The request header in which the ID of each submission is passed
+	// to the next handler. Submission IDs are ULIDs, which sort by
+	// time; they are also available as the
+	// {http.form2json.submission_id} placeholder, and are included in
+	// payloads of class caddy_post_json_v1 as a leading part of type
+	// meta/submission_id, in archive records, published messages and
+	// the handler's logs. Default: Form2json-Submission-Id
+	SubmissionIDHeader string `json:"submission_id_header,omitempty"`
+
+	// If true, the submission ID is also sent to the client, in a
+	// response header of the same name.
+	EchoSubmissionID bool `json:"echo_submission_id,omitempty"`
+
+	// If set, converted payloads are appended to a tamper-evident
+	// archive before the request is passed on.
+	Archive *Archive `json:"archive,omitempty"`
+
+	app      *App
+	logger   *zap.Logger
+	fileSem  chan struct{}
+	filePool *Pool
 }
 
 // CaddyModule returns the Caddy module information.
@@ -51,10 +246,192 @@ func (Handler) CaddyModule() caddy.ModuleInfo {
 }
 
 // Provision sets up the module.
-func (h Handler) Provision(_ caddy.Context) error {
+func (h *Handler) Provision(ctx caddy.Context) error {
+	h.logger = ctx.Logger(h)
+
 	if h.MemoryLimit <= 0 {
 		h.MemoryLimit = defaultMemLimit
 	}
+	if h.CompressMinSize <= 0 {
+		h.CompressMinSize = defaultCompressMinSize
+	}
+	if h.MaxDirectoryDepth <= 0 {
+		h.MaxDirectoryDepth = defaultMaxDirectoryDepth
+	}
+	if h.MaxDirectoryEntries <= 0 {
+		h.MaxDirectoryEntries = defaultMaxDirectoryEntries
+	}
+	if h.SubmissionIDHeader == "" {
+		h.SubmissionIDHeader = defaultSubmissionIDHeader
+	}
+	if h.DebugEchoMaxAge <= 0 {
+		h.DebugEchoMaxAge = caddy.Duration(defaultDebugEchoMaxAge)
+	}
+	if h.FileWorkers <= 0 {
+		h.FileWorkers = 1
+	}
+	if h.MaxFileWorkers > 0 {
+		h.fileSem = make(chan struct{}, h.MaxFileWorkers)
+	}
+	if h.Multipart != nil {
+		h.Multipart.provision()
+	}
+	if h.UploadGuard != nil {
+		h.UploadGuard.provision()
+	}
+	if h.FilePool != "" {
+		app, err := h.loadApp(ctx)
+		if err != nil {
+			return err
+		}
+		if h.filePool, err = app.pool(h.FilePool); err != nil {
+			return err
+		}
+	}
+	if h.Publish != nil {
+		app, err := h.loadApp(ctx)
+		if err != nil {
+			return err
+		}
+		if err := h.Publish.provision(app); err != nil {
+			return fmt.Errorf("publish: %v", err)
+		}
+	}
+
+	// secrets may refer to keys of the app as well as the environment
+	var appErr error
+	repl := caddy.NewReplacer()
+	repl.Map(func(key string) (interface{}, bool) {
+		if !strings.HasPrefix(key, keyPlaceholderPrefix) {
+			return nil, false
+		}
+		app, err := h.loadApp(ctx)
+		if err != nil {
+			appErr = err
+			return nil, false
+		}
+		return app.replaceKey(key)
+	})
+	h.DebugEchoKey = repl.ReplaceAll(h.DebugEchoKey, "")
+	if h.MethodOverride != nil {
+		h.MethodOverride.provision()
+	}
+	if h.Patch != nil {
+		if err := h.Patch.provision(repl); err != nil {
+			return fmt.Errorf("patch: %v", err)
+		}
+	}
+	for i, rule := range h.Groups {
+		if err := rule.provision(); err != nil {
+			return fmt.Errorf("group %d: %v", i, err)
+		}
+	}
+	if h.Encoder == encoderJSONRPC && h.JSONRPC == nil {
+		h.JSONRPC = new(JSONRPC)
+	}
+	if h.JSONRPC != nil {
+		h.JSONRPC.provision()
+	}
+	if h.Encoder == encoderXML && h.XML == nil {
+		h.XML = new(XML)
+	}
+	if h.XML != nil {
+		if err := h.XML.provision(); err != nil {
+			return fmt.Errorf("xml: %v", err)
+		}
+	}
+	if h.Protobuf != nil {
+		if err := h.Protobuf.provision(); err != nil {
+			return fmt.Errorf("protobuf: %v", err)
+		}
+	}
+	if h.Archive != nil {
+		if err := h.Archive.provision(repl, h.logger); err != nil {
+			return fmt.Errorf("archive: %v", err)
+		}
+	}
+	if h.Media != nil {
+		if err := h.Media.provision(repl); err != nil {
+			return fmt.Errorf("media: %v", err)
+		}
+	}
+	if h.Batch != nil {
+		if err := h.Batch.provision(repl); err != nil {
+			return fmt.Errorf("batch: %v", err)
+		}
+	}
+	return appErr
+}
+
+// loadApp returns the form2json app, loading it on first use, so that
+// handlers which share nothing with others do not need it.
+func (h *Handler) loadApp(ctx caddy.Context) (*App, error) {
+	if h.app == nil {
+		appIface, err := ctx.App("form2json")
+		if err != nil {
+			return nil, fmt.Errorf("loading form2json app: %v", err)
+		}
+		h.app = appIface.(*App)
+	}
+	return h.app, nil
+}
+
+// Cleanup releases resources held by the handler.
+func (h Handler) Cleanup() error {
+	var err error
+	if h.Protobuf != nil {
+		err = h.Protobuf.cleanup()
+	}
+	if h.Archive != nil {
+		if aerr := h.Archive.cleanup(); err == nil {
+			err = aerr
+		}
+	}
+	return err
+}
+
+// Validate ensures h's configuration is valid.
+func (h Handler) Validate() error {
+	switch h.Mode {
+	case "", modeArray, modeObject:
+	default:
+		return fmt.Errorf("unrecognized mode: %s", h.Mode)
+	}
+	if h.DirectoryTree && h.Mode != modeObject {
+		return fmt.Errorf("directory_tree requires object mode")
+	}
+	switch h.FileEncoding {
+	case "", fileEncodingBase64, fileEncodingGzip, fileEncodingZstd:
+	default:
+		return fmt.Errorf("unrecognized file encoding: %s", h.FileEncoding)
+	}
+	switch h.Encoder {
+	case "", encoderJSONRPC, encoderXML, encoderRelated:
+	case encoderProtobuf:
+		if h.Protobuf == nil {
+			return fmt.Errorf("protobuf encoder requires protobuf configuration")
+		}
+	case encoderJSONAPI:
+		if h.JSONAPI == nil || (h.JSONAPI.Type == "" && h.JSONAPI.TypeField == "") {
+			return fmt.Errorf("jsonapi encoder requires a type or type_field")
+		}
+	default:
+		return fmt.Errorf("unrecognized encoder: %s", h.Encoder)
+	}
+	if h.Encoder == encoderProtobuf && h.FileEncoding != "" && h.FileEncoding != fileEncodingBase64 {
+		return fmt.Errorf("file encoding %s cannot be combined with the protobuf encoder, which maps raw file contents to bytes fields", h.FileEncoding)
+	}
+	if h.Encoder != "" && h.Patch != nil {
+		return fmt.Errorf("patches cannot be combined with the %s encoder", h.Encoder)
+	}
+	if h.Multipart != nil {
+		if err := h.Multipart.validate(); err != nil {
+			return err
+		}
+	}
+	if h.Batch != nil && !h.hasGroup(h.Batch.Group) {
+		return fmt.Errorf("batch: no group named %q", h.Batch.Group)
+	}
 	return nil
 }
 
@@ -69,47 +446,201 @@ func (h Handler) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyhtt
 		return next.ServeHTTP(w, r)
 	}
 
-	// read and parse the form payload, then close request body (we'll replace it later)
-	err := r.ParseMultipartForm(h.MemoryLimit)
+	// every submission is identified, even if it fails
+	id, err := newSubmissionID()
 	if err != nil {
-		return caddyhttp.Error(http.StatusBadRequest, err)
+		return caddyhttp.Error(http.StatusInternalServerError, err)
+	}
+	if repl, ok := r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer); ok {
+		repl.Set("http.form2json.submission_id", id)
+	}
+	r.Header.Set(h.SubmissionIDHeader, id)
+	if h.EchoSubmissionID {
+		w.Header().Set(h.SubmissionIDHeader, id)
 	}
-	r.Body.Close()
 
-	// assemble form data into structure for JSON
-	var converted []part
-	for name, values := range r.MultipartForm.Value {
-		for _, v := range values {
-			converted = append(converted, part{
-				Name:  name,
-				Type:  "field/text",
-				Value: v,
-			})
+	err = h.serveSubmission(w, r, next, id)
+	if err != nil {
+		// like the server, client errors are only logged when debugging
+		log := h.logger.Error
+		if herr, ok := err.(caddyhttp.HandlerError); ok && herr.StatusCode >= 400 && herr.StatusCode < 500 {
+			log = h.logger.Debug
 		}
+		log("submission failed", zap.String("submission_id", id), zap.Error(err))
 	}
-	for name, files := range r.MultipartForm.File {
-		for _, file := range files {
-			p, err := encodeFileIntoMemory(name, file)
-			if err != nil {
-				return caddyhttp.Error(http.StatusInternalServerError, err)
+	return err
+}
+
+// serveSubmission converts the form submission in r, which has the
+// given ID, and passes it on.
+func (h Handler) serveSubmission(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler, id string) error {
+	start := time.Now()
+
+	// validate-only requests may be signaled by headers or a form field
+	validateOnly := h.validateOnlyRequested(r)
+
+	// when debugging, the outcome of the submission is shown to the
+	// client instead of being passed on, including any errors
+	echo := h.debugEchoEnabled(r)
+	fail := func(err error) error {
+		if !echo {
+			return err
+		}
+		return h.writeDebugEcho(w, debugEcho{
+			Error:   newDebugError(err),
+			Timings: debugTimings{Parse: time.Since(start).String()},
+			Limits:  h.debugLimits(0),
+		})
+	}
+
+	// slow or stalled uploads are aborted if configured
+	var uw *uploadWatch
+	if h.UploadGuard != nil {
+		uw = h.UploadGuard.watch(r)
+	}
+
+	// read and parse the form payload, then close request body (we'll replace it later)
+	form, err := parseForm(r, h.MemoryLimit, h.Multipart, uw)
+	r.Body.Close()
+	if form != nil {
+		// temporary form data files are deleted once we return, at the latest
+		defer form.RemoveAll()
+	}
+	if err != nil {
+		if uerr := uw.Err(); uerr != nil {
+			// aborted uploads are not validation failures, and the
+			// rest of the body will not be read
+			if err := uw.reject(w, uerr); err != nil {
+				return err
 			}
-			converted = append(converted, p)
+			h.logger.Debug("submission failed", zap.String("submission_id", id), zap.Error(uerr))
+			return nil
 		}
+		err = caddyhttp.Error(http.StatusBadRequest, err)
+		if validateOnly {
+			return h.writeValidation(w, r, nil, err)
+		}
+		return fail(err)
 	}
 
-	// delete temporary form data files
-	if err := r.MultipartForm.RemoveAll(); err != nil {
-		return caddyhttp.Error(http.StatusInternalServerError, err)
+	if h.ValidateOnlyField != "" && form.remove(h.ValidateOnlyField) {
+		validateOnly = true
+	}
+
+	// apply and strip control fields such as method overrides
+	original, err := h.prepareForm(r, form)
+	if err != nil {
+		if validateOnly {
+			return h.writeValidation(w, r, nil, err)
+		}
+		return fail(err)
+	}
+
+	// assemble form data into structure for JSON; file contents are
+	// only encoded for validate-only requests if configured, and files
+	// are only sent to the media service if the submission is forwarded
+	converted, err := h.convert(r.Context(), form, !validateOnly || h.ValidateFiles, !validateOnly && !echo)
+	if validateOnly {
+		return h.writeValidation(w, r, converted, err)
+	}
+	if err != nil {
+		return fail(err)
+	}
+
+	// in batch mode, each row is sent as its own request, but the
+	// submission as a whole is echoed, archived and published
+	var rows []partGroup
+	var shared []part
+	if h.Batch != nil {
+		rows, shared, err = h.Batch.split(converted)
+		if err != nil {
+			return fail(err)
+		}
 	}
 
+	parsed := time.Now()
+
 	// prepare new request body buffer
 	buf := bufPool.Get().(*bytes.Buffer)
 	buf.Reset()
 	defer bufPool.Put(buf)
 
 	// encode converted payload into our JSON buffer
-	err = json.NewEncoder(buf).Encode(converted)
+	contentType, class, err := h.encode(buf, converted, original, id)
 	if err != nil {
+		return fail(err)
+	}
+	h.logger.Debug("accepted submission",
+		zap.String("submission_id", id),
+		zap.String("class", class),
+		zap.Int("size", buf.Len()))
+
+	headers := map[string]string{
+		"Content-Type":       contentType,
+		"Content-Type-Class": class,
+		"Content-Length":     strconv.Itoa(buf.Len()),
+		h.SubmissionIDHeader: id,
+	}
+
+	// when debugging, show the client what the upstream would have seen
+	if echo {
+		echoed := debugEcho{
+			Body:    echoBody(buf.Bytes()),
+			Headers: headers,
+			Timings: debugTimings{
+				Parse:  parsed.Sub(start).String(),
+				Encode: time.Since(parsed).String(),
+			},
+			Limits: h.debugLimits(buf.Len()),
+		}
+		if h.Batch != nil {
+			if echoed.Rows, err = h.echoRows(rows, shared, original, id); err != nil {
+				return fail(err)
+			}
+		}
+		return h.writeDebugEcho(w, echoed)
+	}
+
+	// payloads are archived before anyone else sees them
+	if h.Archive != nil {
+		if err := h.Archive.append(id, contentType, class, buf.Bytes()); err != nil {
+			return err
+		}
+		h.logger.Debug("archived submission",
+			zap.String("submission_id", id),
+			zap.String("path", h.Archive.Path))
+	}
+
+	// payloads may be delivered to a sink instead of, or as well as, upstream
+	if h.Publish != nil {
+		msg := Message{ID: id, Header: make(http.Header), Body: buf.Bytes()}
+		msg.Header.Set("Content-Type", contentType)
+		msg.Header.Set("Content-Type-Class", class)
+		msg.Header.Set(h.SubmissionIDHeader, id)
+		if err := h.Publish.publish(r.Context(), msg); err != nil {
+			return err
+		}
+		h.logger.Debug("published submission",
+			zap.String("submission_id", id),
+			zap.String("sink", h.Publish.Sink))
+		if h.Publish.Terminal {
+			w.WriteHeader(http.StatusAccepted)
+			return nil
+		}
+	}
+
+	// rows are encoded as they are sent, so files are still needed
+	if h.Batch != nil {
+		return h.serveBatch(w, r, next, rows, shared, original, id)
+	}
+
+	// gRPC calls are terminal; their response goes to the client
+	if h.Encoder == encoderProtobuf && h.Protobuf.Target != "" {
+		return h.Protobuf.serveCall(w, r, buf.Bytes())
+	}
+
+	// delete temporary form data files, now that their contents are encoded
+	if err := form.RemoveAll(); err != nil {
 		return caddyhttp.Error(http.StatusInternalServerError, err)
 	}
 
@@ -117,36 +648,223 @@ func (h Handler) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyhtt
 	r.Body = ioutil.NopCloser(buf)
 
 	// adjust request headers (and content length separately!)
-	r.Header.Set("Content-Type", "application/json")
-	r.Header.Set("Content-Type-Class", "caddy_post_json_v1")
-	r.Header.Set("Content-Length", strconv.Itoa(buf.Len()))
+	for field, val := range headers {
+		r.Header.Set(field, val)
+	}
 	r.ContentLength = int64(buf.Len())
 
 	return next.ServeHTTP(w, r)
 }
 
-func encodeFileIntoMemory(name string, file *multipart.FileHeader) (part, error) {
-	f, err := file.Open()
+// prepareForm applies the control fields of form, such as method
+// overrides, and removes them from it. If patches are enabled, it
+// returns the verified snapshot of original values.
+func (h Handler) prepareForm(r *http.Request, form *form) (map[string]interface{}, error) {
+	if h.MethodOverride != nil {
+		if err := h.MethodOverride.apply(r, form); err != nil {
+			return nil, err
+		}
+	}
+	if h.Patch != nil {
+		return h.Patch.snapshot(form)
+	}
+	return nil, nil
+}
+
+// convert assembles the parsed form into parts. If encodeFiles is false,
+// file parts only describe the uploaded files and carry no content. If
+// upload is false, files are not sent to the media service, and their
+// parts likewise only describe them.
+func (h Handler) convert(ctx context.Context, form *form, encodeFiles, upload bool) ([]part, error) {
+	var converted []part
+	var jobs []fileJob
+	var dirEntries int
+	for _, fp := range form.parts {
+		if !fp.isFile() {
+			if !h.isDataURLField(fp.Name) || !strings.HasPrefix(fp.value(), "data:") {
+				p, err := h.convertValue(fp)
+				if err != nil {
+					return nil, err
+				}
+				converted = append(converted, p)
+				continue
+			}
+			// data URLs are converted like uploaded files
+			var err error
+			fp, err = h.dataURLPart(fp)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		p, err := h.convertFile(fp)
+		if err != nil {
+			return nil, err
+		}
+		if p.Path != "" {
+			dirEntries++
+			if dirEntries > h.MaxDirectoryEntries {
+				return nil, caddyhttp.Error(http.StatusRequestEntityTooLarge, fieldError{
+					Field:   fp.Name,
+					Message: "too many files in directory upload",
+				})
+			}
+		}
+		if encodeFiles && (upload || h.Media == nil) {
+			jobs = append(jobs, fileJob{index: len(converted), fp: fp})
+		}
+		converted = append(converted, p)
+	}
+	if err := h.processFiles(ctx, converted, jobs); err != nil {
+		return nil, err
+	}
+	return h.applyGroups(converted)
+}
+
+// convertValue converts a non-file form part.
+func (h Handler) convertValue(fp *formPart) (part, error) {
+	p := part{
+		Name:        fp.Name,
+		Type:        "field/text",
+		Value:       fp.value(),
+		ContentType: fp.contentType(),
+	}
+	if h.EmbedJSON && isJSONMediaType(p.ContentType) {
+		if !json.Valid(fp.data) {
+			return part{}, caddyhttp.Error(http.StatusBadRequest, fieldError{
+				Field:   fp.Name,
+				Message: "invalid JSON value",
+			})
+		}
+		p.Type = "field/json"
+		p.Value = ""
+		p.RawValue = json.RawMessage(fp.data)
+	}
+	return p, nil
+}
+
+// convertFile converts an uploaded file, after checking it against the
+// file policies. The part carries only metadata until its contents are
+// filled in by processFile.
+func (h Handler) convertFile(fp *formPart) (part, error) {
+	err := h.checkFilePolicy(fp.Name, fp.contentType(), fp.Size)
 	if err != nil {
 		return part{}, err
 	}
+	fileName, filePath, err := h.splitUploadPath(fp)
+	if err != nil {
+		return part{}, err
+	}
+
+	return part{
+		Name:        fp.Name,
+		Type:        "file",
+		ContentType: fp.contentType(),
+		FileName:    fileName,
+		Path:        filePath,
+		Size:        fp.Size,
+	}, nil
+}
+
+// processFile fills in the contents of the file part p converted from
+// fp.
+func (h Handler) processFile(ctx context.Context, p *part, fp *formPart) error {
+	// files may be stored by a media service instead of being embedded
+	if h.Media != nil {
+		raw, err := h.Media.upload(ctx, fp, p.FileName)
+		if err != nil {
+			return err
+		}
+		p.Type = "file/remote"
+		p.RawValue = raw
+		p.src = fp
+		return nil
+	}
+
+	// multipart/related payloads carry file contents in their own parts
+	if h.Encoder == encoderRelated {
+		p.Type = "file/related"
+		p.src = fp
+		return nil
+	}
+
+	// text-heavy files may be worth compressing
+	if h.FileEncoding != "" && h.FileEncoding != fileEncodingBase64 && fp.Size >= h.CompressMinSize {
+		ok, err := h.compressFile(p, fp)
+		if err != nil {
+			return caddyhttp.Error(http.StatusInternalServerError, err)
+		}
+		if ok {
+			return nil
+		}
+	}
+
+	// base64 is written directly into the output when it is encoded
+	p.Type = "file/base64"
+	p.src = fp
+	return nil
+}
+
+// isJSONMediaType returns true if contentType is application/json or
+// a +json structured syntax suffix type.
+func isJSONMediaType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	return mediaType == "application/json" || strings.HasSuffix(mediaType, "+json")
+}
+
+// checkFilePolicy returns an error if a file of the given media type
+// and size in the named field is not allowed.
+func (h Handler) checkFilePolicy(name, contentType string, size int64) error {
+	if h.MaxFileSize > 0 && size > h.MaxFileSize {
+		return caddyhttp.Error(http.StatusRequestEntityTooLarge, fieldError{
+			Field:   name,
+			Message: "file exceeds maximum size of " + strconv.FormatInt(h.MaxFileSize, 10) + " bytes",
+		})
+	}
+	if len(h.FileTypes) == 0 {
+		return nil
+	}
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	for _, allowed := range h.FileTypes {
+		if strings.EqualFold(mediaType, allowed) ||
+			(strings.HasSuffix(allowed, "/*") && strings.HasPrefix(strings.ToLower(mediaType), strings.ToLower(allowed[:len(allowed)-1]))) {
+			return nil
+		}
+	}
+	return caddyhttp.Error(http.StatusUnsupportedMediaType, fieldError{
+		Field:   name,
+		Message: "file type " + strconv.Quote(mediaType) + " is not allowed",
+	})
+}
+
+// fileValue returns the base64-encoded contents of the file part p.
+func (p part) fileValue() (string, error) {
+	if p.Value != "" || p.src == nil {
+		return p.Value, nil
+	}
+	return encodeFileIntoMemory(p.src)
+}
+
+// encodeFileIntoMemory returns the base64-encoded contents of file.
+func encodeFileIntoMemory(file *formPart) (string, error) {
+	f, err := file.Open()
+	if err != nil {
+		return "", err
+	}
 	defer f.Close()
 
 	buf := new(bytes.Buffer)
 	b64enc := base64.NewEncoder(base64.StdEncoding, buf)
 	_, err = io.Copy(b64enc, f)
 	if err != nil {
-		return part{}, err
+		return "", err
 	}
 	b64enc.Close()
 
-	return part{
-		Name:        name,
-		Type:        "file/base64",
-		Value:       buf.String(),
-		ContentType: file.Header.Get("Content-Type"),
-		FileName:    file.Filename,
-	}, nil
+	return buf.String(), nil
 }
 
 type part struct {
@@ -155,6 +873,35 @@ type part struct {
 	Value       string `json:"value,omitempty"`
 	ContentType string `json:"content_type,omitempty"`
 	FileName    string `json:"file_name,omitempty"`
+	Path        string `json:"path,omitempty"`
+	Size        int64  `json:"size,omitempty"`
+
+	// CompressedSize is the size of compressed file contents, before
+	// base64 encoding.
+	CompressedSize int64 `json:"compressed_size,omitempty"`
+
+	// RawValue, if set, is emitted as the value instead of Value,
+	// for parts whose value is already JSON.
+	RawValue json.RawMessage `json:"-"`
+
+	// rows holds the groups collected into a group part.
+	rows []partGroup
+
+	// src is the form part holding the contents of a file part. Unless
+	// they are held in Value, they are encoded from it: as raw parts of
+	// a multipart/related payload, or as base64 written directly into
+	// the output by the part writer. Encoders of raw contents, such as
+	// protobuf's bytes fields, always read them from it.
+	src *formPart
+}
+
+// MarshalJSON encodes p with the part writer.
+func (p part) MarshalJSON() ([]byte, error) {
+	buf := new(bytes.Buffer)
+	if err := writePart(buf, p); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
 }
 
 var bufPool = sync.Pool{
@@ -165,8 +912,32 @@ var bufPool = sync.Pool{
 
 const defaultMemLimit = 1024 * 1024 * 2
 
+const (
+	defaultMaxDirectoryDepth   = 16
+	defaultMaxDirectoryEntries = 1000
+)
+
+// Output modes
+const (
+	modeArray  = "array"
+	modeObject = "object"
+)
+
+// Output encoders
+const (
+	encoderJSONAPI  = "jsonapi"
+	encoderJSONRPC  = "jsonrpc"
+	encoderProtobuf = "protobuf"
+	encoderXML      = "xml"
+	encoderRelated  = "related"
+)
+
+const defaultSubmissionIDHeader = "Form2json-Submission-Id"
+
 // Interface guards
 var (
 	_ caddy.Provisioner           = (*Handler)(nil)
+	_ caddy.Validator             = (*Handler)(nil)
+	_ caddy.CleanerUpper          = (*Handler)(nil)
 	_ caddyhttp.MiddlewareHandler = (*Handler)(nil)
 )
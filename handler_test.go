@@ -0,0 +1,129 @@
+// Copyright 2021 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package form2json
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+)
+
+// newTestHandler returns a handler with the defaults set by Provision,
+// without the form2json app.
+func newTestHandler() Handler {
+	return Handler{
+		MemoryLimit:         defaultMemLimit,
+		CompressMinSize:     defaultCompressMinSize,
+		MaxDirectoryDepth:   defaultMaxDirectoryDepth,
+		MaxDirectoryEntries: defaultMaxDirectoryEntries,
+		SubmissionIDHeader:  defaultSubmissionIDHeader,
+		DebugEchoMaxAge:     caddy.Duration(defaultDebugEchoMaxAge),
+		FileWorkers:         1,
+		logger:              zap.NewNop(),
+	}
+}
+
+// testField is a field of a multipart test request; it is a file if
+// it has a file name.
+type testField struct {
+	name        string
+	value       string
+	fileName    string
+	contentType string
+}
+
+// newFormRequest returns a multipart/form-data POST request with the
+// given fields.
+func newFormRequest(t *testing.T, fields ...testField) *http.Request {
+	body := new(bytes.Buffer)
+	mw := multipart.NewWriter(body)
+	for _, f := range fields {
+		header := make(textproto.MIMEHeader)
+		disposition := `form-data; name="` + f.name + `"`
+		if f.fileName != "" {
+			disposition += `; filename="` + f.fileName + `"`
+		}
+		header.Set("Content-Disposition", disposition)
+		if f.contentType != "" {
+			header.Set("Content-Type", f.contentType)
+		}
+		pw, err := mw.CreatePart(header)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pw.Write([]byte(f.value))
+	}
+	mw.Close()
+
+	req := httptest.NewRequest(http.MethodPost, "/", body)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	return req
+}
+
+// upstream records the request passed to the next handler.
+type upstream struct {
+	called bool
+	req    *http.Request
+	body   []byte
+}
+
+func (u *upstream) ServeHTTP(w http.ResponseWriter, r *http.Request) error {
+	u.called = true
+	u.req = r
+	var err error
+	u.body, err = ioutil.ReadAll(r.Body)
+	return err
+}
+
+// parts decodes the caddy_post_json_v1 payload received, and returns
+// its parts after the leading one identifying the submission.
+func (u *upstream) parts() ([]part, error) {
+	var parts []part
+	if err := json.Unmarshal(u.body, &parts); err != nil {
+		return nil, err
+	}
+	id := u.req.Header.Get(defaultSubmissionIDHeader)
+	if len(parts) == 0 || parts[0].Type != "meta/submission_id" || parts[0].Value != id {
+		return nil, fmt.Errorf("payload does not start with submission ID %s", id)
+	}
+	return parts[1:], nil
+}
+
+// serveTest serves req with h, and returns the response and what the
+// next handler received.
+func serveTest(t *testing.T, h Handler, req *http.Request) (*httptest.ResponseRecorder, *upstream, error) {
+	w := httptest.NewRecorder()
+	next := new(upstream)
+	err := h.ServeHTTP(w, req, next)
+	return w, next, err
+}
+
+// statusOf returns the status code of a handler error, or 0.
+func statusOf(err error) int {
+	if herr, ok := err.(caddyhttp.HandlerError); ok {
+		return herr.StatusCode
+	}
+	return 0
+}
@@ -0,0 +1,167 @@
+// Copyright 2021 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package form2json
+
+import (
+	"bytes"
+	"net/http"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+// JSONAPI shapes the payload into a JSON:API resource document:
+//
+//	{"data": {"type": ..., "id": ..., "attributes": {...}, "relationships": {...}, "meta": {...}}}
+//
+// Only fields become attributes. Uploaded files, which are content sent
+// along with the resource rather than attributes of it, are placed in
+// the resource's meta object, keyed like attributes.
+type JSONAPI struct {
+	// The resource type.
+	Type string `json:"type,omitempty"`
+
+	// A form field holding the resource type, used if Type is empty.
+	// The field is not included in the attributes.
+	TypeField string `json:"type_field,omitempty"`
+
+	// A form field holding the resource ID, for updates. The field is
+	// not included in the attributes.
+	IDField string `json:"id_field,omitempty"`
+
+	// Fields holding the IDs of related resources, mapped to the type
+	// of those resources. Fields occurring more than once become to-many
+	// relationships. All other fields become attributes.
+	Relationships map[string]string `json:"relationships,omitempty"`
+}
+
+// encodeJSONAPI writes the JSON:API document for the converted parts to
+// buf, returning its Content-Type and Content-Type-Class.
+func (h Handler) encodeJSONAPI(buf *bytes.Buffer, converted []part) (string, string, error) {
+	var fields, files []part
+	for _, p := range converted {
+		if p.hasFile() {
+			files = append(files, p)
+		} else {
+			fields = append(fields, p)
+		}
+	}
+	obj, err := h.buildObject(fields)
+	if err != nil {
+		return "", "", err
+	}
+	var meta map[string]interface{}
+	if len(files) > 0 {
+		if meta, err = h.buildObject(files); err != nil {
+			return "", "", err
+		}
+	}
+	return h.JSONAPI.encode(buf, obj, meta)
+}
+
+// hasFile returns true if p is a file, or a group with a file in any
+// of its rows.
+func (p part) hasFile() bool {
+	if strings.HasPrefix(p.Type, "file") {
+		return true
+	}
+	for _, row := range p.rows {
+		for _, rp := range row.parts {
+			if rp.hasFile() {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// encode writes the JSON:API document with the attributes in obj and
+// the files in meta to buf, returning its Content-Type and
+// Content-Type-Class.
+func (ja *JSONAPI) encode(buf *bytes.Buffer, obj, meta map[string]interface{}) (string, string, error) {
+	res := jsonAPIResource{Type: ja.Type}
+	if ja.TypeField != "" {
+		if t := takeString(obj, ja.TypeField); res.Type == "" {
+			res.Type = t
+		}
+	}
+	if res.Type == "" {
+		return "", "", caddyhttp.Error(http.StatusBadRequest, fieldError{
+			Field:   ja.TypeField,
+			Message: "missing resource type",
+		})
+	}
+	if ja.IDField != "" {
+		res.ID = takeString(obj, ja.IDField)
+	}
+
+	for field, relType := range ja.Relationships {
+		val, ok := obj[field]
+		if !ok {
+			continue
+		}
+		delete(obj, field)
+		if res.Relationships == nil {
+			res.Relationships = make(map[string]jsonAPIRelationship)
+		}
+		switch v := val.(type) {
+		case string:
+			res.Relationships[field] = jsonAPIRelationship{
+				Data: jsonAPIIdentifier{Type: relType, ID: v},
+			}
+		case []interface{}:
+			ids := make([]jsonAPIIdentifier, 0, len(v))
+			for _, id := range v {
+				s, ok := id.(string)
+				if !ok {
+					return "", "", invalidRelationship(field)
+				}
+				ids = append(ids, jsonAPIIdentifier{Type: relType, ID: s})
+			}
+			res.Relationships[field] = jsonAPIRelationship{Data: ids}
+		default:
+			return "", "", invalidRelationship(field)
+		}
+	}
+
+	res.Attributes = obj
+	res.Meta = meta
+	doc := map[string]interface{}{"data": res}
+	return "application/vnd.api+json", "caddy_post_jsonapi_v1", encodeJSON(buf, doc)
+}
+
+func invalidRelationship(field string) error {
+	return caddyhttp.Error(http.StatusBadRequest, fieldError{
+		Field:   field,
+		Message: "relationship must hold resource IDs",
+	})
+}
+
+type jsonAPIResource struct {
+	Type          string                         `json:"type"`
+	ID            string                         `json:"id,omitempty"`
+	Attributes    map[string]interface{}         `json:"attributes,omitempty"`
+	Relationships map[string]jsonAPIRelationship `json:"relationships,omitempty"`
+	Meta          map[string]interface{}         `json:"meta,omitempty"`
+}
+
+type jsonAPIRelationship struct {
+	Data interface{} `json:"data"`
+}
+
+type jsonAPIIdentifier struct {
+	Type string `json:"type"`
+	ID   string `json:"id"`
+}
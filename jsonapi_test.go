@@ -0,0 +1,126 @@
+// Copyright 2021 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package form2json
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestJSONAPI(t *testing.T) {
+	for i, tc := range []struct {
+		jsonAPI  JSONAPI
+		fields   []testField
+		status   int
+		expected string
+	}{
+		{
+			jsonAPI:  JSONAPI{Type: "articles"},
+			fields:   []testField{{name: "title", value: "Hello"}, {name: "body", value: "World"}},
+			expected: `{"data":{"type":"articles","attributes":{"body":"World","title":"Hello"}}}`,
+		},
+		{
+			jsonAPI:  JSONAPI{Type: "articles", TypeField: "_type", IDField: "_id"},
+			fields:   []testField{{name: "_type", value: "posts"}, {name: "_id", value: "7"}, {name: "title", value: "Hello"}},
+			expected: `{"data":{"type":"articles","id":"7","attributes":{"title":"Hello"}}}`,
+		},
+		{
+			jsonAPI:  JSONAPI{TypeField: "_type"},
+			fields:   []testField{{name: "_type", value: "posts"}, {name: "title", value: "Hello"}},
+			expected: `{"data":{"type":"posts","attributes":{"title":"Hello"}}}`,
+		},
+		{
+			jsonAPI: JSONAPI{Type: "articles", Relationships: map[string]string{"author": "people", "tags": "tags"}},
+			fields: []testField{
+				{name: "title", value: "Hello"},
+				{name: "author", value: "9"},
+				{name: "tags", value: "1"},
+				{name: "tags", value: "2"},
+			},
+			expected: `{"data":{"type":"articles","attributes":{"title":"Hello"},"relationships":{` +
+				`"author":{"data":{"type":"people","id":"9"}},` +
+				`"tags":{"data":[{"type":"tags","id":"1"},{"type":"tags","id":"2"}]}}}}`,
+		},
+		{
+			// files are not attributes
+			jsonAPI: JSONAPI{Type: "articles"},
+			fields: []testField{
+				{name: "title", value: "Hello"},
+				{name: "cover", value: "img", fileName: "cover.png", contentType: "image/png"},
+			},
+			expected: `{"data":{"type":"articles","attributes":{"title":"Hello"},"meta":{` +
+				`"cover":{"type":"file/base64","value":"aW1n","content_type":"image/png","file_name":"cover.png","size":3}}}}`,
+		},
+		{
+			jsonAPI: JSONAPI{Type: "articles"},
+			fields: []testField{
+				{name: "cover", value: "img", fileName: "cover.png", contentType: "image/png"},
+			},
+			expected: `{"data":{"type":"articles","meta":{` +
+				`"cover":{"type":"file/base64","value":"aW1n","content_type":"image/png","file_name":"cover.png","size":3}}}}`,
+		},
+		{
+			jsonAPI: JSONAPI{TypeField: "_type"},
+			fields:  []testField{{name: "title", value: "Hello"}},
+			status:  http.StatusBadRequest,
+		},
+		{
+			// nor relationships
+			jsonAPI: JSONAPI{Type: "articles", Relationships: map[string]string{"author": "people"}},
+			fields:  []testField{{name: "author", value: "img", fileName: "a.png"}, {name: "author_", value: "x"}},
+			expected: `{"data":{"type":"articles","attributes":{"author_":"x"},"meta":{` +
+				`"author":{"type":"file/base64","value":"aW1n","file_name":"a.png","size":3}}}}`,
+		},
+	} {
+		h := newTestHandler()
+		h.Encoder = encoderJSONAPI
+		jsonAPI := tc.jsonAPI
+		h.JSONAPI = &jsonAPI
+		_, next, err := serveTest(t, h, newFormRequest(t, tc.fields...))
+		if tc.status != 0 {
+			if statusOf(err) != tc.status {
+				t.Errorf("Test %d: expected status %d, got %v", i, tc.status, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test %d: unexpected error: %v", i, err)
+			continue
+		}
+		if actual := next.req.Header.Get("Content-Type"); actual != "application/vnd.api+json" {
+			t.Errorf("Test %d: expected content type application/vnd.api+json, got %s", i, actual)
+		}
+		if actual := string(next.body); actual != tc.expected+"\n" {
+			t.Errorf("Test %d: expected:\n%s\ngot:\n%s", i, tc.expected, actual)
+		}
+	}
+}
+
+func TestPartHasFile(t *testing.T) {
+	for i, tc := range []struct {
+		p        part
+		expected bool
+	}{
+		{p: part{Type: "field/text"}},
+		{p: part{Type: "file"}, expected: true},
+		{p: part{Type: "file/remote"}, expected: true},
+		{p: part{Type: "group", rows: []partGroup{{parts: []part{{Type: "field/text"}}}}}},
+		{p: part{Type: "group", rows: []partGroup{{parts: []part{{Type: "field/text"}}}, {parts: []part{{Type: "file/base64"}}}}}, expected: true},
+	} {
+		if actual := tc.p.hasFile(); actual != tc.expected {
+			t.Errorf("Test %d: expected %t, got %t", i, tc.expected, actual)
+		}
+	}
+}
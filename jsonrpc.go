@@ -0,0 +1,75 @@
+// Copyright 2021 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package form2json
+
+import (
+	"bytes"
+	"net/http"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+// JSONRPC shapes the payload into a JSON-RPC 2.0 request whose params
+// are the object form of the payload, and whose id is the submission
+// ID, so that responses can be matched to submissions.
+type JSONRPC struct {
+	// The method to call. If empty, the method is read from MethodField.
+	Method string `json:"method,omitempty"`
+
+	// A form field holding the method to call, used if Method is empty.
+	// The field is never included in the params. Default: _rpc_method
+	MethodField string `json:"method_field,omitempty"`
+
+	// If true, requests are sent as notifications, without an id.
+	Notification bool `json:"notification,omitempty"`
+}
+
+func (rpc *JSONRPC) provision() {
+	if rpc.MethodField == "" {
+		rpc.MethodField = "_rpc_method"
+	}
+}
+
+// encode writes the JSON-RPC request for obj, submission id, to buf,
+// returning its Content-Type and Content-Type-Class.
+func (rpc *JSONRPC) encode(buf *bytes.Buffer, obj map[string]interface{}, id string) (string, string, error) {
+	method := rpc.Method
+	if m := takeString(obj, rpc.MethodField); method == "" {
+		method = m
+	}
+	if method == "" {
+		return "", "", caddyhttp.Error(http.StatusBadRequest, fieldError{
+			Field:   rpc.MethodField,
+			Message: "missing RPC method",
+		})
+	}
+
+	req := jsonRPCRequest{
+		JSONRPC: "2.0",
+		Method:  method,
+		Params:  obj,
+	}
+	if !rpc.Notification {
+		req.ID = id
+	}
+	return "application/json", "caddy_post_jsonrpc_v1", encodeJSON(buf, req)
+}
+
+type jsonRPCRequest struct {
+	JSONRPC string                 `json:"jsonrpc"`
+	Method  string                 `json:"method"`
+	Params  map[string]interface{} `json:"params"`
+	ID      string                 `json:"id,omitempty"`
+}
@@ -0,0 +1,80 @@
+// Copyright 2021 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package form2json
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestJSONRPC(t *testing.T) {
+	for i, tc := range []struct {
+		rpc      JSONRPC
+		fields   []testField
+		status   int
+		expected string
+	}{
+		{
+			rpc:      JSONRPC{Method: "subscribe"},
+			fields:   []testField{{name: "email", value: "a@example.com"}},
+			expected: `{"jsonrpc":"2.0","method":"subscribe","params":{"email":"a@example.com"},"id":"{id}"}`,
+		},
+		{
+			fields:   []testField{{name: "_rpc_method", value: "unsubscribe"}, {name: "email", value: "a@example.com"}},
+			expected: `{"jsonrpc":"2.0","method":"unsubscribe","params":{"email":"a@example.com"},"id":"{id}"}`,
+		},
+		{
+			rpc:      JSONRPC{Method: "subscribe"},
+			fields:   []testField{{name: "_rpc_method", value: "unsubscribe"}},
+			expected: `{"jsonrpc":"2.0","method":"subscribe","params":{},"id":"{id}"}`,
+		},
+		{
+			rpc:      JSONRPC{Method: "log", Notification: true},
+			fields:   []testField{{name: "line", value: "x"}},
+			expected: `{"jsonrpc":"2.0","method":"log","params":{"line":"x"}}`,
+		},
+		{
+			fields: []testField{{name: "email", value: "a@example.com"}},
+			status: http.StatusBadRequest,
+		},
+	} {
+		h := newTestHandler()
+		h.Encoder = encoderJSONRPC
+		rpc := tc.rpc
+		rpc.provision()
+		h.JSONRPC = &rpc
+		_, next, err := serveTest(t, h, newFormRequest(t, tc.fields...))
+		if tc.status != 0 {
+			if statusOf(err) != tc.status {
+				t.Errorf("Test %d: expected status %d, got %v", i, tc.status, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test %d: unexpected error: %v", i, err)
+			continue
+		}
+		// requests are identified by the submission ID
+		id := next.req.Header.Get(h.SubmissionIDHeader)
+		if id == "" {
+			t.Errorf("Test %d: expected a submission ID", i)
+		}
+		expected := strings.Replace(tc.expected, "{id}", id, 1)
+		if actual := string(next.body); actual != expected+"\n" {
+			t.Errorf("Test %d: expected:\n%s\ngot:\n%s", i, expected, actual)
+		}
+	}
+}
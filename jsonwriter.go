@@ -0,0 +1,230 @@
+// Copyright 2021 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package form2json
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"sort"
+	"strconv"
+	"unicode/utf8"
+)
+
+// writePart writes p to buf as a JSON object, producing the same output
+// as encoding/json would for the part struct, but without reflection or
+// intermediate copies: file contents held by p.src are base64-encoded
+// straight into buf.
+func writePart(buf *bytes.Buffer, p part) error {
+	buf.WriteByte('{')
+	first := true
+	key := func(k string) {
+		if !first {
+			buf.WriteByte(',')
+		}
+		first = false
+		buf.WriteByte('"')
+		buf.WriteString(k)
+		buf.WriteString(`":`)
+	}
+	str := func(k, v string) {
+		if v != "" {
+			key(k)
+			writeJSONString(buf, v)
+		}
+	}
+	num := func(k string, v int64) {
+		if v != 0 {
+			key(k)
+			buf.WriteString(strconv.FormatInt(v, 10))
+		}
+	}
+
+	str("name", p.Name)
+	str("type", p.Type)
+	switch {
+	case p.rows != nil:
+		key("value")
+		if err := writeValue(buf, p.rowObjects()); err != nil {
+			return err
+		}
+	case p.RawValue != nil:
+		key("value")
+		if err := writeRawJSON(buf, p.RawValue); err != nil {
+			return err
+		}
+	case p.Value == "" && p.src != nil && p.Type == "file/base64":
+		key("value")
+		if err := writeBase64(buf, p.src); err != nil {
+			return err
+		}
+	default:
+		str("value", p.Value)
+	}
+	str("content_type", p.ContentType)
+	str("file_name", p.FileName)
+	str("path", p.Path)
+	num("size", p.Size)
+	num("compressed_size", p.CompressedSize)
+	buf.WriteByte('}')
+	return nil
+}
+
+// writeValue writes v, a value of the object form of parts, to buf as
+// JSON. Like writePart, it writes file parts within v without copies;
+// objects have their keys sorted, as encoding/json would.
+func writeValue(buf *bytes.Buffer, v interface{}) error {
+	switch val := v.(type) {
+	case nil:
+		buf.WriteString("null")
+	case string:
+		writeJSONString(buf, val)
+	case part:
+		return writePart(buf, val)
+	case json.RawMessage:
+		return writeRawJSON(buf, val)
+	case []interface{}:
+		buf.WriteByte('[')
+		for i, elem := range val {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			if err := writeValue(buf, elem); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte(']')
+	case map[string]interface{}:
+		return writeObject(buf, val)
+	case dirTree:
+		return writeObject(buf, val)
+	default:
+		data, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		buf.Write(data)
+	}
+	return nil
+}
+
+// writeObject writes obj to buf as a JSON object with sorted keys.
+func writeObject(buf *bytes.Buffer, obj map[string]interface{}) error {
+	keys := make([]string, 0, len(obj))
+	for k := range obj {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	buf.WriteByte('{')
+	for i, k := range keys {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		writeJSONString(buf, k)
+		buf.WriteByte(':')
+		if err := writeValue(buf, obj[k]); err != nil {
+			return err
+		}
+	}
+	buf.WriteByte('}')
+	return nil
+}
+
+// writeRawJSON writes the JSON text raw to buf compacted, with HTML
+// characters escaped as encoding/json does for json.RawMessage.
+func writeRawJSON(buf *bytes.Buffer, raw json.RawMessage) error {
+	compacted := new(bytes.Buffer)
+	if err := json.Compact(compacted, raw); err != nil {
+		return err
+	}
+	json.HTMLEscape(buf, compacted.Bytes())
+	return nil
+}
+
+// writeBase64 writes the contents of fp to buf as a base64 JSON string.
+func writeBase64(buf *bytes.Buffer, fp *formPart) error {
+	f, err := fp.Open()
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	buf.Grow(base64.StdEncoding.EncodedLen(int(fp.Size)) + 2)
+	buf.WriteByte('"')
+	b64enc := base64.NewEncoder(base64.StdEncoding, buf)
+	if _, err := io.Copy(b64enc, f); err != nil {
+		return err
+	}
+	if err := b64enc.Close(); err != nil {
+		return err
+	}
+	buf.WriteByte('"')
+	return nil
+}
+
+// writeJSONString writes s to buf as a JSON string, escaped exactly as
+// encoding/json escapes strings (including its HTML-safe escaping).
+func writeJSONString(buf *bytes.Buffer, s string) {
+	const hex = "0123456789abcdef"
+	buf.WriteByte('"')
+	start := 0
+	for i := 0; i < len(s); {
+		if b := s[i]; b < utf8.RuneSelf {
+			if b >= 0x20 && b != '"' && b != '\\' && b != '<' && b != '>' && b != '&' {
+				i++
+				continue
+			}
+			buf.WriteString(s[start:i])
+			switch b {
+			case '"', '\\':
+				buf.WriteByte('\\')
+				buf.WriteByte(b)
+			case '\n':
+				buf.WriteString(`\n`)
+			case '\r':
+				buf.WriteString(`\r`)
+			case '\t':
+				buf.WriteString(`\t`)
+			default:
+				buf.WriteString(`\u00`)
+				buf.WriteByte(hex[b>>4])
+				buf.WriteByte(hex[b&0xf])
+			}
+			i++
+			start = i
+			continue
+		}
+		r, size := utf8.DecodeRuneInString(s[i:])
+		if r == utf8.RuneError && size == 1 {
+			buf.WriteString(s[start:i])
+			buf.WriteString(`\ufffd`)
+			i += size
+			start = i
+			continue
+		}
+		if r == '\u2028' || r == '\u2029' {
+			buf.WriteString(s[start:i])
+			buf.WriteString(`\u202`)
+			buf.WriteByte(hex[r&0xf])
+			i += size
+			start = i
+			continue
+		}
+		i += size
+	}
+	buf.WriteString(s[start:])
+	buf.WriteByte('"')
+}
@@ -0,0 +1,228 @@
+// Copyright 2021 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package form2json
+
+import (
+	"bytes"
+	"encoding/json"
+	"strconv"
+	"testing"
+)
+
+func TestWritePart(t *testing.T) {
+	for i, p := range []part{
+		{Name: "title", Type: "field/text", Value: "Hello, world"},
+		{Name: "escapes", Type: "field/text", Value: "\"quoted\"\\ \n\r\t\x00\x1f <b>&amp;</b>    é 😀"},
+		{Name: "empty"},
+		{Name: "json", Type: "field/json", RawValue: json.RawMessage(` { "a" : [1, "<b>"] } `)},
+		{Name: "photo", Type: "file/base64", ContentType: "image/png", FileName: "a.png", Path: "dir/a.png", Size: 5, src: &formPart{data: []byte("hello")}},
+		{Name: "doc", Type: "file/gzip+base64", Value: "H4sI", Size: 1000, CompressedSize: 3},
+	} {
+		expected, err := json.Marshal(reflectPartOf(t, p))
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf := new(bytes.Buffer)
+		if err := writePart(buf, p); err != nil {
+			t.Errorf("Test %d: unexpected error: %v", i, err)
+			continue
+		}
+		if buf.String() != string(expected) {
+			t.Errorf("Test %d: expected:\n%s\ngot:\n%s", i, expected, buf)
+		}
+	}
+}
+
+func TestWritePartGroup(t *testing.T) {
+	parts := benchmarkGroupParts(2, 16)
+	expected, err := json.Marshal(reflectPartOf(t, parts[0]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := new(bytes.Buffer)
+	if err := writePart(buf, parts[0]); err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != string(expected) {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, buf)
+	}
+}
+
+// The part writer encodes files straight into the output, while
+// encoding/json needs their base64 contents as strings first.
+
+func BenchmarkEncodeParts(b *testing.B) {
+	benchmarkWriter(b, benchmarkParts(8, 64<<10))
+}
+
+func BenchmarkEncodePartsReflect(b *testing.B) {
+	benchmarkReflect(b, benchmarkParts(8, 64<<10))
+}
+
+func BenchmarkEncodeGroups(b *testing.B) {
+	benchmarkWriter(b, benchmarkGroupParts(8, 64<<10))
+}
+
+func BenchmarkEncodeGroupsReflect(b *testing.B) {
+	benchmarkReflect(b, benchmarkGroupParts(8, 64<<10))
+}
+
+func benchmarkWriter(b *testing.B, converted []part) {
+	buf := new(bytes.Buffer)
+	b.ReportAllocs()
+	b.SetBytes(partsSize(converted))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		buf.Reset()
+		if err := encodeParts(buf, converted); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func benchmarkReflect(b *testing.B, converted []part) {
+	buf := new(bytes.Buffer)
+	b.ReportAllocs()
+	b.SetBytes(partsSize(converted))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		buf.Reset()
+		rps := make([]reflectPart, len(converted))
+		for j, p := range converted {
+			rp, err := materialize(p)
+			if err != nil {
+				b.Fatal(err)
+			}
+			rps[j] = rp
+		}
+		if err := json.NewEncoder(buf).Encode(rps); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// benchmarkParts returns a text field and a file of the given size
+// for each of n fields.
+func benchmarkParts(n, size int) []part {
+	var converted []part
+	for i := 0; i < n; i++ {
+		name := strconv.Itoa(i)
+		converted = append(converted, part{Name: "title" + name, Type: "field/text", Value: "Title <" + name + ">"})
+		converted = append(converted, benchmarkFile("photo"+name, size))
+	}
+	return converted
+}
+
+// benchmarkGroupParts returns a group of n rows, each holding a text
+// field and a file of the given size.
+func benchmarkGroupParts(n, size int) []part {
+	rows := make([]partGroup, n)
+	for i := range rows {
+		rows[i] = partGroup{index: strconv.Itoa(i), parts: benchmarkParts(1, size)}
+		rows[i].obj = make(map[string]interface{})
+		for _, p := range rows[i].parts {
+			rows[i].obj[p.Name] = objectValue(p)
+		}
+	}
+	return []part{{Name: "rows", Type: "group", rows: rows}}
+}
+
+func benchmarkFile(name string, size int) part {
+	data := bytes.Repeat([]byte("0123456789abcdef"), size/16)
+	return part{
+		Name:        name,
+		Type:        "file/base64",
+		ContentType: "application/octet-stream",
+		FileName:    name + ".bin",
+		Size:        int64(len(data)),
+		src:         &formPart{Name: name, data: data},
+	}
+}
+
+func partsSize(converted []part) int64 {
+	var size int64
+	for _, p := range converted {
+		size += p.Size
+		for _, row := range p.rows {
+			size += partsSize(row.parts)
+		}
+	}
+	return size
+}
+
+// reflectPart is a part as encoded with encoding/json, which has no
+// access to the contents of files held by p.src.
+type reflectPart struct {
+	Name           string      `json:"name,omitempty"`
+	Type           string      `json:"type,omitempty"`
+	Value          interface{} `json:"value,omitempty"`
+	ContentType    string      `json:"content_type,omitempty"`
+	FileName       string      `json:"file_name,omitempty"`
+	Path           string      `json:"path,omitempty"`
+	Size           int64       `json:"size,omitempty"`
+	CompressedSize int64       `json:"compressed_size,omitempty"`
+}
+
+// materialize returns p as a reflectPart, with the contents of files
+// (including those within groups) encoded as base64 strings.
+func materialize(p part) (reflectPart, error) {
+	rp := reflectPart{
+		Name:           p.Name,
+		Type:           p.Type,
+		ContentType:    p.ContentType,
+		FileName:       p.FileName,
+		Path:           p.Path,
+		Size:           p.Size,
+		CompressedSize: p.CompressedSize,
+	}
+	switch {
+	case p.rows != nil:
+		objects := make([]map[string]interface{}, len(p.rows))
+		for i, row := range p.rows {
+			objects[i] = make(map[string]interface{})
+			for _, rowPart := range row.parts {
+				val, err := materialize(rowPart)
+				if err != nil {
+					return rp, err
+				}
+				val.Name = ""
+				objects[i][rowPart.Name] = val
+				if rowPart.src == nil {
+					objects[i][rowPart.Name] = val.Value
+				}
+			}
+		}
+		rp.Value = objects
+	case p.RawValue != nil:
+		rp.Value = p.RawValue
+	case p.Value != "":
+		rp.Value = p.Value
+	case p.src != nil:
+		value, err := encodeFileIntoMemory(p.src)
+		if err != nil {
+			return rp, err
+		}
+		rp.Value = value
+	}
+	return rp, nil
+}
+
+func reflectPartOf(t *testing.T, p part) reflectPart {
+	rp, err := materialize(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rp
+}
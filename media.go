@@ -0,0 +1,172 @@
+// Copyright 2021 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package form2json
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+// Media sends uploaded files to a media service. Each file is POSTed
+// separately, and the service must respond with a JSON document
+// describing the stored file, which replaces the file's contents as the
+// value of its part (with type "file/remote"). Files are only uploaded
+// for submissions which are passed on; validate-only requests and debug
+// echoes report just the metadata of their files.
+type Media struct {
+	// The URL files are POSTed to. Placeholders are evaluated at
+	// provision time. Required.
+	URL string `json:"url"`
+
+	// How files are sent: "multipart" (default) as multipart/form-data
+	// with the file in the field named "file", or "raw" as the request
+	// body, with the file name in the Content-Disposition header.
+	Format string `json:"format,omitempty"`
+
+	// How long to wait for each upload. Default: 60s
+	Timeout caddy.Duration `json:"timeout,omitempty"`
+
+	client *http.Client
+}
+
+func (m *Media) provision(repl *caddy.Replacer) error {
+	m.URL = repl.ReplaceAll(m.URL, "")
+	if m.URL == "" {
+		return fmt.Errorf("url is required")
+	}
+	switch m.Format {
+	case "":
+		m.Format = mediaMultipart
+	case mediaMultipart, mediaRaw:
+	default:
+		return fmt.Errorf("unrecognized format: %s", m.Format)
+	}
+	if m.Timeout <= 0 {
+		m.Timeout = caddy.Duration(defaultMediaTimeout)
+	}
+	m.client = &http.Client{Timeout: time.Duration(m.Timeout)}
+	return nil
+}
+
+// upload sends the contents of fp to the media service as fileName,
+// returning the service's JSON response.
+func (m *Media) upload(ctx context.Context, fp *formPart, fileName string) (json.RawMessage, error) {
+	f, err := fp.Open()
+	if err != nil {
+		return nil, caddyhttp.Error(http.StatusInternalServerError, err)
+	}
+	defer f.Close()
+
+	contentType := fp.contentType()
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	disposition := fmt.Sprintf(`attachment; filename="%s"`, escapeQuotes(fileName))
+
+	// the file is copied into the request body by its own goroutine,
+	// which may still be reading when the request is done (such as when
+	// the service responds before reading the whole body), so it must
+	// be stopped before the file is closed
+	pr, pw := io.Pipe()
+	var mw *multipart.Writer
+	if m.Format == mediaMultipart {
+		mw = multipart.NewWriter(pw)
+	}
+	copied := make(chan struct{})
+	go func() {
+		defer close(copied)
+		if mw == nil {
+			_, err := io.Copy(pw, f)
+			pw.CloseWithError(err)
+			return
+		}
+		header := make(textproto.MIMEHeader)
+		header.Set("Content-Disposition",
+			fmt.Sprintf(`form-data; name="file"; filename="%s"`, escapeQuotes(fileName)))
+		header.Set("Content-Type", contentType)
+		w, err := mw.CreatePart(header)
+		if err == nil {
+			_, err = io.Copy(w, f)
+		}
+		if err == nil {
+			err = mw.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+	defer func() {
+		pr.Close()
+		<-copied
+	}()
+	reqType := contentType
+	if mw != nil {
+		reqType = mw.FormDataContentType()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, m.URL, pr)
+	if err != nil {
+		return nil, caddyhttp.Error(http.StatusInternalServerError, err)
+	}
+	req.Header.Set("Content-Type", reqType)
+	if m.Format == mediaRaw {
+		req.Header.Set("Content-Disposition", disposition)
+		req.ContentLength = fp.Size
+	}
+
+	resp, err := m.client.Do(req)
+	if err != nil {
+		return nil, caddyhttp.Error(http.StatusBadGateway, err)
+	}
+	defer resp.Body.Close()
+	respBody, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxMediaResponseBytes))
+	if err != nil {
+		return nil, caddyhttp.Error(http.StatusBadGateway, err)
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return nil, caddyhttp.Error(http.StatusBadGateway,
+			fmt.Errorf("media service responded with status %d", resp.StatusCode))
+	}
+	if !json.Valid(respBody) {
+		return nil, caddyhttp.Error(http.StatusBadGateway,
+			fmt.Errorf("media service response is not JSON"))
+	}
+	return json.RawMessage(respBody), nil
+}
+
+// escapeQuotes escapes s for use in a quoted header parameter.
+func escapeQuotes(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s)
+}
+
+// Media upload formats
+const (
+	mediaMultipart = "multipart"
+	mediaRaw       = "raw"
+)
+
+const (
+	defaultMediaTimeout   = 60 * time.Second
+	maxMediaResponseBytes = 1 << 20
+)
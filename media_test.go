@@ -0,0 +1,108 @@
+// Copyright 2021 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package form2json
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+func TestMediaUpload(t *testing.T) {
+	contents := strings.Repeat("x", 1<<20)
+	req := newFormRequest(t, testField{name: "photo", value: contents, fileName: "a.jpg", contentType: "image/jpeg"})
+	// a small memory limit keeps the file on disk
+	form, err := parseForm(req, 1024, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer form.RemoveAll()
+	fp := form.parts[0]
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/early" {
+			// respond without reading the file
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		var name, data string
+		switch r.URL.Query().Get("format") {
+		case mediaMultipart:
+			_, params, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+			part, err := multipart.NewReader(r.Body, params["boundary"]).NextPart()
+			if err != nil || part.FormName() != "file" || part.Header.Get("Content-Type") != "image/jpeg" {
+				http.Error(w, "bad part", http.StatusBadRequest)
+				return
+			}
+			name = part.FileName()
+			b, _ := ioutil.ReadAll(part)
+			data = string(b)
+		case mediaRaw:
+			_, params, _ := mime.ParseMediaType(r.Header.Get("Content-Disposition"))
+			if r.ContentLength != int64(len(contents)) || r.Header.Get("Content-Type") != "image/jpeg" {
+				http.Error(w, "bad request", http.StatusBadRequest)
+				return
+			}
+			name = params["filename"]
+			b, _ := ioutil.ReadAll(r.Body)
+			data = string(b)
+		}
+		if data != contents {
+			http.Error(w, "bad contents", http.StatusBadRequest)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"name": name})
+	}))
+	defer srv.Close()
+
+	for i, tc := range []struct {
+		format    string
+		path      string
+		expectErr bool
+		expected  string
+	}{
+		{format: mediaMultipart, path: "/", expected: `{"name":"a \"b\".jpg"}` + "\n"},
+		{format: mediaRaw, path: "/", expected: `{"name":"a \"b\".jpg"}` + "\n"},
+		{format: mediaMultipart, path: "/early", expectErr: true},
+		{format: mediaRaw, path: "/early", expectErr: true},
+	} {
+		m := Media{URL: srv.URL + tc.path + "?format=" + tc.format, Format: tc.format}
+		if err := m.provision(caddy.NewReplacer()); err != nil {
+			t.Fatal(err)
+		}
+		actual, err := m.upload(context.Background(), fp, `a "b".jpg`)
+		if tc.expectErr {
+			if statusOf(err) != http.StatusBadGateway {
+				t.Errorf("Test %d: expected status 502, got %v", i, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test %d: unexpected error: %v", i, err)
+			continue
+		}
+		if string(actual) != tc.expected {
+			t.Errorf("Test %d: expected %s, got %s", i, tc.expected, actual)
+		}
+	}
+}
@@ -0,0 +1,85 @@
+// Copyright 2021 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package form2json
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+// MethodOverride rewrites the method of form submissions, Rails-style,
+// so that HTML forms can reach REST upstreams expecting PUT, PATCH or
+// DELETE.
+type MethodOverride struct {
+	// The form field holding the method. It is always removed from the
+	// converted payload. Default: _method
+	Field string `json:"field,omitempty"`
+
+	// The request header holding the method, which takes precedence
+	// over the field. Default: X-HTTP-Method-Override
+	Header string `json:"header,omitempty"`
+
+	// The methods which may be requested. Default: PUT, PATCH, DELETE
+	Methods []string `json:"methods,omitempty"`
+}
+
+func (mo *MethodOverride) provision() {
+	if mo.Field == "" {
+		mo.Field = "_method"
+	}
+	if mo.Header == "" {
+		mo.Header = "X-HTTP-Method-Override"
+	}
+	if len(mo.Methods) == 0 {
+		mo.Methods = []string{http.MethodPut, http.MethodPatch, http.MethodDelete}
+	}
+	for i, m := range mo.Methods {
+		mo.Methods[i] = strings.ToUpper(m)
+	}
+}
+
+// apply rewrites the method of r if an override is present in its
+// headers or in form, and strips the override from both.
+func (mo *MethodOverride) apply(r *http.Request, form *form) error {
+	var method string
+	for _, fp := range form.parts {
+		if fp.Name == mo.Field && !fp.isFile() {
+			method = fp.value()
+			break
+		}
+	}
+	form.remove(mo.Field)
+	if hdr := r.Header.Get(mo.Header); hdr != "" {
+		method = hdr
+		r.Header.Del(mo.Header)
+	}
+	if method == "" {
+		return nil
+	}
+
+	method = strings.ToUpper(strings.TrimSpace(method))
+	for _, allowed := range mo.Methods {
+		if method == allowed {
+			r.Method = method
+			return nil
+		}
+	}
+	return caddyhttp.Error(http.StatusBadRequest, fieldError{
+		Field:   mo.Field,
+		Message: "method override not allowed: " + method,
+	})
+}
@@ -0,0 +1,104 @@
+// Copyright 2021 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package form2json
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestMethodOverride(t *testing.T) {
+	for i, tc := range []struct {
+		mo       MethodOverride
+		fields   []testField
+		header   string
+		status   int
+		expected string
+		body     string
+	}{
+		{
+			fields:   []testField{{name: "name", value: "x"}},
+			expected: http.MethodPost,
+			body:     `{"name":"x"}`,
+		},
+		{
+			fields:   []testField{{name: "_method", value: "put"}, {name: "name", value: "x"}},
+			expected: http.MethodPut,
+			body:     `{"name":"x"}`,
+		},
+		{
+			fields:   []testField{{name: "_method", value: " delete "}},
+			expected: http.MethodDelete,
+			body:     `{}`,
+		},
+		{
+			fields:   []testField{{name: "_method", value: "PUT"}},
+			header:   "patch",
+			expected: http.MethodPatch,
+			body:     `{}`,
+		},
+		{
+			// a file is not an override, but is still removed
+			fields:   []testField{{name: "_method", value: "PUT", fileName: "m.txt"}},
+			expected: http.MethodPost,
+			body:     `{}`,
+		},
+		{
+			mo:       MethodOverride{Field: "verb", Header: "X-Verb", Methods: []string{"purge"}},
+			fields:   []testField{{name: "verb", value: "PURGE"}, {name: "_method", value: "PUT"}},
+			expected: "PURGE",
+			body:     `{"_method":"PUT"}`,
+		},
+		{
+			fields: []testField{{name: "_method", value: "TRACE"}},
+			status: http.StatusBadRequest,
+		},
+		{
+			mo:     MethodOverride{Methods: []string{"purge"}},
+			header: "PUT",
+			status: http.StatusBadRequest,
+		},
+	} {
+		mo := tc.mo
+		mo.provision()
+		h := newTestHandler()
+		h.Mode = modeObject
+		h.MethodOverride = &mo
+		req := newFormRequest(t, tc.fields...)
+		if tc.header != "" {
+			req.Header.Set(mo.Header, tc.header)
+		}
+		_, next, err := serveTest(t, h, req)
+		if tc.status != 0 {
+			if statusOf(err) != tc.status {
+				t.Errorf("Test %d: expected status %d, got %v", i, tc.status, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test %d: unexpected error: %v", i, err)
+			continue
+		}
+		if next.req.Method != tc.expected {
+			t.Errorf("Test %d: expected method %s, got %s", i, tc.expected, next.req.Method)
+		}
+		if hdr := next.req.Header.Get(mo.Header); hdr != "" {
+			t.Errorf("Test %d: expected override header to be removed, got %s", i, hdr)
+		}
+		if actual := string(next.body); actual != tc.body+"\n" {
+			t.Errorf("Test %d: expected body %s, got %s", i, tc.body, actual)
+		}
+	}
+}
@@ -0,0 +1,486 @@
+// Copyright 2021 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package form2json
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/quotedprintable"
+	"net/textproto"
+	"strings"
+)
+
+// MultipartParser configures the parsing of multipart/form-data
+// payloads, replacing Go's mime/multipart reader, which accepts some
+// malformed payloads and rejects others that real clients send.
+type MultipartParser struct {
+	// How strictly payloads are parsed. "strict" requires conformance
+	// to RFC 7578 and RFC 2046: CRLF line endings, a closing boundary,
+	// well-formed headers without folding, exactly one form-data
+	// Content-Disposition with a name per part, no duplicate
+	// Content-Type, and no Content-Transfer-Encoding. "lenient" accepts
+	// LF line endings, a missing closing boundary, folded and malformed
+	// header lines (which are skipped), loosely quoted Content-Disposition
+	// parameters, and quoted-printable parts; parts without a name are
+	// skipped. Default: lenient
+	Level string `json:"level,omitempty"`
+
+	// The maximum number of header lines in a part. Default: 16
+	MaxPartHeaders int `json:"max_part_headers,omitempty"`
+
+	// The maximum size in bytes of the headers of a part. Default: 8 KB
+	MaxPartHeaderBytes int `json:"max_part_header_bytes,omitempty"`
+}
+
+func (mp *MultipartParser) provision() {
+	if mp.Level == "" {
+		mp.Level = parserLenient
+	}
+	if mp.MaxPartHeaders <= 0 {
+		mp.MaxPartHeaders = defaultMaxPartHeaders
+	}
+	if mp.MaxPartHeaderBytes <= 0 {
+		mp.MaxPartHeaderBytes = defaultMaxPartHeaderBytes
+	}
+}
+
+func (mp *MultipartParser) validate() error {
+	switch mp.Level {
+	case parserStrict, parserLenient:
+		return nil
+	default:
+		return fmt.Errorf("unrecognized multipart parser level: %s", mp.Level)
+	}
+}
+
+// newReader returns a reader for the multipart payload in body, which
+// has the given Content-Type.
+func (mp *MultipartParser) newReader(body io.Reader, contentType string) (*multipartReader, error) {
+	_, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return nil, fmt.Errorf("multipart: malformed Content-Type: %v", err)
+	}
+	boundary := params["boundary"]
+	if boundary == "" {
+		return nil, fmt.Errorf("multipart: missing boundary")
+	}
+	strict := mp.Level == parserStrict
+	if strict && !validBoundary(boundary) {
+		return nil, fmt.Errorf("multipart: invalid boundary")
+	}
+
+	// every header line must fit in the buffer, so it is at least as
+	// large as the header size limit
+	size := mp.MaxPartHeaderBytes + 2
+	if size < 4096 {
+		size = 4096
+	}
+	return &multipartReader{
+		parser: mp,
+		strict: strict,
+		br:     bufio.NewReaderSize(body, size),
+		dash:   []byte("--" + boundary),
+	}, nil
+}
+
+// multipartReader reads the parts of a multipart payload.
+type multipartReader struct {
+	parser *MultipartParser
+	strict bool
+	br     *bufio.Reader
+	dash   []byte // "--" + boundary
+
+	started bool        // true once the first boundary has been read
+	final   bool        // true once the closing boundary has been read
+	current *partReader // the body of the current part
+}
+
+// nextPart returns the next named part and a reader for its body, or
+// io.EOF if there are no more parts. The body of the previous part is
+// discarded.
+func (mr *multipartReader) nextPart() (*formPart, io.Reader, error) {
+	for {
+		if err := mr.advance(); err != nil {
+			return nil, nil, err
+		}
+		header, err := mr.readHeader()
+		if err != nil {
+			return nil, nil, err
+		}
+		fp, err := mr.newPart(header)
+		if err != nil {
+			return nil, nil, err
+		}
+		mr.current = &partReader{mr: mr}
+		if fp == nil {
+			// skipped
+			continue
+		}
+
+		var body io.Reader = mr.current
+		if strings.EqualFold(header.Get("Content-Transfer-Encoding"), "quoted-printable") {
+			header.Del("Content-Transfer-Encoding")
+			body = quotedprintable.NewReader(body)
+		}
+		return fp, body, nil
+	}
+}
+
+// advance moves past the next boundary, returning io.EOF if it is the
+// closing boundary.
+func (mr *multipartReader) advance() error {
+	if mr.current != nil {
+		if _, err := io.Copy(ioutil.Discard, mr.current); err != nil {
+			return err
+		}
+		mr.current = nil
+	} else if !mr.started {
+		if err := mr.skipPreamble(); err != nil {
+			return err
+		}
+	}
+	mr.started = true
+	if mr.final {
+		return io.EOF
+	}
+	return nil
+}
+
+// skipPreamble reads up to and including the first boundary.
+func (mr *multipartReader) skipPreamble() error {
+	lineStart := true
+	for {
+		line, err := mr.br.ReadSlice('\n')
+		if err == io.EOF && len(line) == 0 {
+			if mr.strict {
+				return fmt.Errorf("multipart: no boundary found")
+			}
+			// an empty payload has no parts
+			mr.final = true
+			return nil
+		}
+		if err != nil && err != bufio.ErrBufferFull && err != io.EOF {
+			return err
+		}
+		if lineStart && err != bufio.ErrBufferFull {
+			if final, ok, lerr := mr.delimiter(line); lerr != nil {
+				return lerr
+			} else if ok {
+				mr.final = final
+				return nil
+			}
+		}
+		lineStart = err == nil
+	}
+}
+
+// delimiter reports whether line is a boundary line, and if so,
+// whether it is the closing boundary. A boundary may be followed by
+// linear whitespace (transport padding).
+func (mr *multipartReader) delimiter(line []byte) (final, ok bool, err error) {
+	rest, eol := splitEOL(line)
+	if !bytes.HasPrefix(rest, mr.dash) {
+		return false, false, nil
+	}
+	rest = rest[len(mr.dash):]
+	if bytes.HasPrefix(rest, []byte("--")) {
+		final = true
+		rest = rest[2:]
+	}
+	if len(bytes.TrimLeft(rest, " \t")) != 0 {
+		// boundaries are not supposed to occur in content, but a line
+		// which merely starts with one is not a delimiter
+		return false, false, nil
+	}
+	if mr.strict && !bytes.Equal(eol, crlf) && !(final && len(eol) == 0) {
+		return false, false, fmt.Errorf("multipart: boundary not terminated by CRLF")
+	}
+	return final, true, nil
+}
+
+// readHeader reads the header section of a part.
+func (mr *multipartReader) readHeader() (textproto.MIMEHeader, error) {
+	header := make(textproto.MIMEHeader)
+	var lines, size int
+	var lastKey string
+	for {
+		line, err := mr.br.ReadSlice('\n')
+		if err == bufio.ErrBufferFull {
+			return nil, fmt.Errorf("multipart: part headers exceed %d bytes", mr.parser.MaxPartHeaderBytes)
+		}
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+		size += len(line)
+		if size > mr.parser.MaxPartHeaderBytes {
+			return nil, fmt.Errorf("multipart: part headers exceed %d bytes", mr.parser.MaxPartHeaderBytes)
+		}
+		text, eol := splitEOL(line)
+		if mr.strict && !bytes.Equal(eol, crlf) {
+			return nil, fmt.Errorf("multipart: header line not terminated by CRLF")
+		}
+		if len(text) == 0 {
+			return header, nil
+		}
+
+		// obsolete line folding continues the previous header
+		if text[0] == ' ' || text[0] == '\t' {
+			if mr.strict {
+				return nil, fmt.Errorf("multipart: folded header lines are not allowed")
+			}
+			if lastKey != "" {
+				values := header[lastKey]
+				values[len(values)-1] += " " + strings.TrimSpace(string(text))
+			}
+			continue
+		}
+
+		lines++
+		if lines > mr.parser.MaxPartHeaders {
+			return nil, fmt.Errorf("multipart: more than %d part headers", mr.parser.MaxPartHeaders)
+		}
+		colon := bytes.IndexByte(text, ':')
+		if colon <= 0 || !validHeaderKey(text[:colon]) {
+			if mr.strict {
+				return nil, fmt.Errorf("multipart: malformed header line: %q", text)
+			}
+			lastKey = ""
+			continue
+		}
+		key := textproto.CanonicalMIMEHeaderKey(string(text[:colon]))
+		header.Add(key, strings.TrimSpace(string(text[colon+1:])))
+		lastKey = key
+	}
+}
+
+// newPart returns the form part described by header, or nil if the
+// part should be skipped.
+func (mr *multipartReader) newPart(header textproto.MIMEHeader) (*formPart, error) {
+	if mr.strict {
+		for _, key := range []string{"Content-Disposition", "Content-Type"} {
+			if len(header[key]) > 1 {
+				return nil, fmt.Errorf("multipart: duplicate %s header", key)
+			}
+		}
+		switch cte := strings.ToLower(header.Get("Content-Transfer-Encoding")); cte {
+		case "", "7bit", "8bit", "binary":
+		default:
+			return nil, fmt.Errorf("multipart: Content-Transfer-Encoding %q is not allowed", cte)
+		}
+	}
+
+	disposition := header.Get("Content-Disposition")
+	dispType, params, err := mime.ParseMediaType(disposition)
+	if err != nil && !mr.strict {
+		dispType, params = laxDisposition(disposition)
+		err = nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("multipart: malformed Content-Disposition: %v", err)
+	}
+	name := params["name"]
+	if dispType != "form-data" || name == "" {
+		if mr.strict {
+			return nil, fmt.Errorf("multipart: part is missing a form-data Content-Disposition with a name")
+		}
+		return nil, nil
+	}
+	return &formPart{
+		Name:     name,
+		FileName: params["filename"],
+		Header:   header,
+	}, nil
+}
+
+// partReader reads the body of a part up to the next boundary.
+type partReader struct {
+	mr      *multipartReader
+	pre     []byte // line ending of the previous line, to be read first
+	buf     []byte // unread content
+	eol     []byte // line ending held back in case a boundary follows
+	midLine bool   // true if the last read did not end a line
+	cr      bool   // true if a CR ending a full buffer is held back
+	done    bool
+	err     error
+}
+
+func (pr *partReader) Read(p []byte) (int, error) {
+	for len(pr.pre) == 0 && len(pr.buf) == 0 {
+		if pr.err != nil {
+			return 0, pr.err
+		}
+		if pr.done {
+			return 0, io.EOF
+		}
+		pr.fill()
+	}
+	n := copy(p, pr.pre)
+	pr.pre = pr.pre[n:]
+	m := copy(p[n:], pr.buf)
+	pr.buf = pr.buf[m:]
+	return n + m, nil
+}
+
+// fill reads the next line or chunk of the body.
+func (pr *partReader) fill() {
+	mr := pr.mr
+	line, err := mr.br.ReadSlice('\n')
+
+	// a CR which ended a full buffer either starts the CRLF ending
+	// the line, or is content
+	var held []byte
+	if pr.cr {
+		pr.cr = false
+		if err == nil && len(line) == 1 {
+			pr.eol, pr.midLine = crlf, false
+			return
+		}
+		held = cr
+	}
+
+	if err == io.EOF && len(line) == 0 {
+		if mr.strict {
+			pr.err = io.ErrUnexpectedEOF
+			return
+		}
+		// a missing closing boundary ends the payload
+		pr.pre = held
+		pr.done = true
+		mr.final = true
+		return
+	}
+	if err != nil && err != bufio.ErrBufferFull && err != io.EOF {
+		pr.err = err
+		return
+	}
+	complete := err == nil
+
+	// the closing boundary may be the last line of the payload
+	if !pr.midLine && err != bufio.ErrBufferFull {
+		final, ok, derr := mr.delimiter(line)
+		if derr != nil {
+			pr.err = derr
+			return
+		}
+		if ok {
+			if mr.strict && !bytes.Equal(pr.eol, crlf) {
+				pr.err = fmt.Errorf("multipart: boundary not preceded by CRLF")
+				return
+			}
+			pr.done = true
+			mr.final = final
+			return
+		}
+	}
+
+	pr.pre, pr.eol = pr.eol, nil
+	if held != nil {
+		pr.pre = held
+	}
+	switch {
+	case complete:
+		pr.buf, pr.eol = splitEOL(line)
+	case err == bufio.ErrBufferFull && line[len(line)-1] == '\r':
+		pr.buf, pr.cr = line[:len(line)-1], true
+	default:
+		pr.buf = line
+	}
+	pr.midLine = !complete
+}
+
+// splitEOL splits line into its text and line ending, if any.
+func splitEOL(line []byte) (text, eol []byte) {
+	switch {
+	case bytes.HasSuffix(line, crlf):
+		return line[:len(line)-2], crlf
+	case bytes.HasSuffix(line, lf):
+		return line[:len(line)-1], lf
+	default:
+		return line, nil
+	}
+}
+
+// laxDisposition parses a Content-Disposition header which is not
+// valid according to RFC 2183, such as one with unquoted file names
+// containing spaces, as sent by some clients.
+func laxDisposition(v string) (string, map[string]string) {
+	params := make(map[string]string)
+	fields := strings.Split(v, ";")
+	for _, field := range fields[1:] {
+		eq := strings.IndexByte(field, '=')
+		if eq < 0 {
+			continue
+		}
+		key := strings.ToLower(strings.TrimSpace(field[:eq]))
+		value := strings.TrimSpace(field[eq+1:])
+		if len(value) >= 2 && value[0] == '"' && value[len(value)-1] == '"' {
+			value = value[1 : len(value)-1]
+		}
+		if _, ok := params[key]; !ok {
+			params[key] = value
+		}
+	}
+	return strings.ToLower(strings.TrimSpace(fields[0])), params
+}
+
+// validBoundary returns true if b is a boundary allowed by RFC 2046.
+func validBoundary(b string) bool {
+	if len(b) == 0 || len(b) > 70 || b[len(b)-1] == ' ' {
+		return false
+	}
+	for _, c := range b {
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9':
+		case strings.ContainsRune("'()+_,-./:=? ", c):
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// validHeaderKey returns true if k is a valid header field name token.
+func validHeaderKey(k []byte) bool {
+	for _, c := range k {
+		if c <= ' ' || c >= 0x7f || strings.IndexByte(`"(),/:;<=>?@[\]{}`, c) >= 0 {
+			return false
+		}
+	}
+	return len(k) > 0
+}
+
+var (
+	crlf = []byte("\r\n")
+	lf   = []byte("\n")
+	cr   = []byte("\r")
+)
+
+// Multipart parser levels.
+const (
+	parserStrict  = "strict"
+	parserLenient = "lenient"
+)
+
+const (
+	defaultMaxPartHeaders     = 16
+	defaultMaxPartHeaderBytes = 8 << 10
+)
@@ -0,0 +1,220 @@
+// Copyright 2021 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package form2json
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestMultipartParser(t *testing.T) {
+	part := func(name, value string) string {
+		return "--b\r\nContent-Disposition: form-data; name=\"" + name + "\"\r\n\r\n" + value + "\r\n"
+	}
+	long := func(n int) string { return strings.Repeat("x", n) }
+	const end = "--b--\r\n"
+
+	type testCase struct {
+		level          string
+		maxHeaders     int
+		maxHeaderBytes int
+		body           string
+		expected       []testField
+		expectErr      bool
+	}
+	tests := []testCase{
+		{
+			level:    parserStrict,
+			body:     part("a", "1") + part("b", "2\r\n3") + end,
+			expected: []testField{{name: "a", value: "1"}, {name: "b", value: "2\r\n3"}},
+		},
+		{
+			// preamble and epilogue are ignored
+			level:    parserStrict,
+			body:     "preamble\r\n" + part("a", "1") + end + "epilogue\r\n",
+			expected: []testField{{name: "a", value: "1"}},
+		},
+		{
+			level:    parserLenient,
+			body:     "preamble\n" + part("a", "1") + end + "epilogue",
+			expected: []testField{{name: "a", value: "1"}},
+		},
+		{
+			// a line which starts with the boundary is content, and
+			// boundaries may be followed by transport padding
+			level:    parserStrict,
+			body:     "--b \t\r\nContent-Disposition: form-data; name=\"a\"\r\n\r\n--bx\r\n--b-- \r\n",
+			expected: []testField{{name: "a", value: "--bx"}},
+		},
+		{
+			// a CR at the very end of a full buffer which is content
+			level:          parserStrict,
+			maxHeaderBytes: 8192,
+			body:           part("a", long(8193)+"\ry") + end,
+			expected:       []testField{{name: "a", value: long(8193) + "\ry"}},
+		},
+		{
+			// a CR at the very end of a full buffer which is content,
+			// at the end of a payload missing its closing boundary
+			level:          parserLenient,
+			maxHeaderBytes: 8192,
+			body:           "--b\r\nContent-Disposition: form-data; name=\"a\"\r\n\r\n" + long(8193) + "\r",
+			expected:       []testField{{name: "a", value: long(8193) + "\r"}},
+		},
+		{
+			level:     parserStrict,
+			body:      part("a", "1"),
+			expectErr: true,
+		},
+		{
+			level:    parserLenient,
+			body:     part("a", "1"),
+			expected: []testField{{name: "a", value: "1"}},
+		},
+		{
+			level:     parserStrict,
+			body:      strings.Replace(part("a", "1")+end, "\r\n", "\n", -1),
+			expectErr: true,
+		},
+		{
+			level:    parserLenient,
+			body:     strings.Replace(part("a", "1\r\n2")+end, "\r\n", "\n", -1),
+			expected: []testField{{name: "a", value: "1\n2"}},
+		},
+		{
+			// strict mode requires the CRLF before a boundary
+			level:     parserStrict,
+			body:      "--b\r\nContent-Disposition: form-data; name=\"a\"\r\n\r\n1\n--b--\r\n",
+			expectErr: true,
+		},
+		{
+			level:      parserStrict,
+			maxHeaders: 2,
+			body:       "--b\r\nContent-Disposition: form-data; name=\"a\"\r\nContent-Type: text/plain\r\n\r\n1\r\n" + end,
+			expected:   []testField{{name: "a", value: "1", contentType: "text/plain"}},
+		},
+		{
+			level:      parserLenient,
+			maxHeaders: 2,
+			body:       "--b\r\nContent-Disposition: form-data; name=\"a\"\r\nContent-Type: text/plain\r\nX-A: 1\r\n\r\n1\r\n" + end,
+			expectErr:  true,
+		},
+		{
+			level:          parserLenient,
+			maxHeaderBytes: 64,
+			body:           "--b\r\nContent-Disposition: form-data; name=\"a\"\r\nX-A: " + long(64) + "\r\n\r\n1\r\n" + end,
+			expectErr:      true,
+		},
+		{
+			// a header line longer than the buffer
+			level:          parserLenient,
+			maxHeaderBytes: 64,
+			body:           "--b\r\nContent-Disposition: form-data; name=\"a\"\r\nX-A: " + long(8192) + "\r\n\r\n1\r\n" + end,
+			expectErr:      true,
+		},
+	}
+
+	// lines which end around the end of the buffer (8194 bytes), with
+	// the CRLF after them split across reads
+	for _, level := range []string{parserStrict, parserLenient} {
+		for _, n := range []int{8191, 8192, 8193, 8194, 16386, 16387, 16388} {
+			for _, value := range []string{long(n), long(n) + "\r\ny", "y\r\n" + long(n)} {
+				tests = append(tests, testCase{
+					level:          level,
+					maxHeaderBytes: 8192,
+					body:           part("a", value) + part("b", "2") + end,
+					expected:       []testField{{name: "a", value: value}, {name: "b", value: "2"}},
+				})
+			}
+		}
+	}
+	// and around the end of the smallest buffer (4096 bytes)
+	for _, n := range []int{4094, 4095, 4096} {
+		tests = append(tests, testCase{
+			level:          parserStrict,
+			maxHeaderBytes: 64,
+			body:           part("a", long(n)) + end,
+			expected:       []testField{{name: "a", value: long(n)}},
+		})
+	}
+
+	for i, tc := range tests {
+		mp := &MultipartParser{
+			Level:              tc.level,
+			MaxPartHeaders:     tc.maxHeaders,
+			MaxPartHeaderBytes: tc.maxHeaderBytes,
+		}
+		mp.provision()
+		actual, err := readTestParts(mp, tc.body)
+		if tc.expectErr {
+			if err == nil {
+				t.Errorf("Test %d: expected error, got parts %v", i, actual)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test %d: unexpected error: %v", i, err)
+			continue
+		}
+		if !reflect.DeepEqual(actual, tc.expected) {
+			t.Errorf("Test %d: expected parts %s, got %s", i, summarizeParts(tc.expected), summarizeParts(actual))
+		}
+	}
+}
+
+// readTestParts parses body with mp and returns its parts.
+func readTestParts(mp *MultipartParser, body string) ([]testField, error) {
+	mr, err := mp.newReader(strings.NewReader(body), "multipart/form-data; boundary=b")
+	if err != nil {
+		return nil, err
+	}
+	var fields []testField
+	for {
+		fp, r, err := mr.nextPart()
+		if err == io.EOF {
+			return fields, nil
+		}
+		if err != nil {
+			return fields, err
+		}
+		value, err := ioutil.ReadAll(r)
+		if err != nil {
+			return fields, err
+		}
+		fields = append(fields, testField{
+			name:        fp.Name,
+			value:       string(value),
+			fileName:    fp.FileName,
+			contentType: fp.Header.Get("Content-Type"),
+		})
+	}
+}
+
+// summarizeParts describes fields without printing long values.
+func summarizeParts(fields []testField) string {
+	var parts []string
+	for _, f := range fields {
+		value := f.value
+		if len(value) > 16 {
+			value = fmt.Sprintf("%.8s...%s (%d bytes)", value, value[len(value)-8:], len(value))
+		}
+		parts = append(parts, fmt.Sprintf("%s=%q", f.name, value))
+	}
+	return "[" + strings.Join(parts, " ") + "]"
+}
@@ -0,0 +1,234 @@
+// Copyright 2021 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package form2json
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+// Patch converts edit form submissions into patches containing only
+// the fields that changed. The page rendering the form embeds a
+// snapshot of the original values in a hidden field, in the form
+// "<payload>.<signature>", where payload is the base64url-encoded JSON
+// object of original values (keyed like object mode output) and
+// signature is the base64url-encoded HMAC-SHA256 of payload.
+type Patch struct {
+	// The hidden field holding the signed snapshot. Default: _original
+	Field string `json:"field,omitempty"`
+
+	// The secret key used to sign snapshots. Placeholders such as
+	// {env.FORM2JSON_PATCH_KEY} are supported. Required.
+	Key string `json:"key,omitempty"`
+
+	// The patch format: "merge" for an RFC 7396 JSON Merge Patch
+	// (default), or "json-patch" for an RFC 6902 JSON Patch.
+	Format string `json:"format,omitempty"`
+
+	// If true, fields in the snapshot which are missing from the
+	// submission (such as unchecked checkboxes) are removed by the
+	// patch. By default they are left unchanged.
+	RemoveMissing bool `json:"remove_missing,omitempty"`
+}
+
+func (p *Patch) provision(repl *caddy.Replacer) error {
+	if p.Field == "" {
+		p.Field = "_original"
+	}
+	p.Key = repl.ReplaceAll(p.Key, "")
+	if p.Key == "" {
+		return fmt.Errorf("key is required")
+	}
+	switch p.Format {
+	case "":
+		p.Format = patchMerge
+	case patchMerge, patchJSON:
+	default:
+		return fmt.Errorf("unrecognized format: %s", p.Format)
+	}
+	return nil
+}
+
+// snapshot removes the snapshot field from form and returns the
+// original values it holds, after verifying its signature.
+func (p *Patch) snapshot(form *form) (map[string]interface{}, error) {
+	var signed string
+	for _, fp := range form.parts {
+		if fp.Name == p.Field && !fp.isFile() {
+			signed = fp.value()
+			break
+		}
+	}
+	form.remove(p.Field)
+
+	invalid := func(msg string) error {
+		return caddyhttp.Error(http.StatusBadRequest, fieldError{Field: p.Field, Message: msg})
+	}
+	if signed == "" {
+		return nil, invalid("missing snapshot of original values")
+	}
+	dot := strings.LastIndexByte(signed, '.')
+	if dot < 0 {
+		return nil, invalid("malformed snapshot")
+	}
+	payload := signed[:dot]
+	sig, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(signed[dot+1:], "="))
+	if err != nil {
+		return nil, invalid("malformed snapshot signature")
+	}
+	mac := hmac.New(sha256.New, []byte(p.Key))
+	mac.Write([]byte(payload))
+	if !hmac.Equal(sig, mac.Sum(nil)) {
+		return nil, invalid("invalid snapshot signature")
+	}
+	data, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(payload, "="))
+	if err != nil {
+		return nil, invalid("malformed snapshot payload")
+	}
+	var original map[string]interface{}
+	if err := json.Unmarshal(data, &original); err != nil {
+		return nil, invalid("malformed snapshot payload")
+	}
+	return original, nil
+}
+
+// encode writes the patch from original to submitted to buf,
+// returning its Content-Type and Content-Type-Class.
+func (p *Patch) encode(buf *bytes.Buffer, submitted, original map[string]interface{}) (string, string, error) {
+	// normalize submitted values into the same types as the snapshot
+	data, err := json.Marshal(submitted)
+	if err != nil {
+		return "", "", caddyhttp.Error(http.StatusInternalServerError, err)
+	}
+	var current map[string]interface{}
+	if err := json.Unmarshal(data, &current); err != nil {
+		return "", "", caddyhttp.Error(http.StatusInternalServerError, err)
+	}
+
+	if p.Format == patchJSON {
+		ops := p.jsonPatch("", original, current, nil)
+		if ops == nil {
+			ops = []patchOp{}
+		}
+		return "application/json-patch+json", "caddy_post_json_patch_v1", encodeJSON(buf, ops)
+	}
+	return "application/merge-patch+json", "caddy_post_merge_patch_v1", encodeJSON(buf, p.mergePatch(original, current))
+}
+
+// mergePatch returns the RFC 7396 merge patch transforming original
+// into current.
+func (p *Patch) mergePatch(original, current map[string]interface{}) map[string]interface{} {
+	patch := make(map[string]interface{})
+	for key, cur := range current {
+		orig, ok := original[key]
+		if ok && reflect.DeepEqual(orig, cur) {
+			continue
+		}
+		origObj, origIsObj := orig.(map[string]interface{})
+		curObj, curIsObj := cur.(map[string]interface{})
+		if origIsObj && curIsObj {
+			patch[key] = p.mergePatch(origObj, curObj)
+			continue
+		}
+		patch[key] = cur
+	}
+	if p.RemoveMissing {
+		for key := range original {
+			if _, ok := current[key]; !ok {
+				patch[key] = nil
+			}
+		}
+	}
+	return patch
+}
+
+// jsonPatch appends to ops the RFC 6902 operations transforming the
+// object original at path into current.
+func (p *Patch) jsonPatch(path string, original, current map[string]interface{}, ops []patchOp) []patchOp {
+	keys := make([]string, 0, len(current))
+	for key := range current {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		cur := current[key]
+		ptr := path + "/" + escapePointer(key)
+		orig, ok := original[key]
+		switch {
+		case !ok:
+			ops = append(ops, patchOp{Op: "add", Path: ptr, Value: rawJSON(cur)})
+		case reflect.DeepEqual(orig, cur):
+		default:
+			origObj, origIsObj := orig.(map[string]interface{})
+			curObj, curIsObj := cur.(map[string]interface{})
+			if origIsObj && curIsObj {
+				ops = p.jsonPatch(ptr, origObj, curObj, ops)
+				continue
+			}
+			ops = append(ops, patchOp{Op: "replace", Path: ptr, Value: rawJSON(cur)})
+		}
+	}
+
+	if p.RemoveMissing {
+		var missing []string
+		for key := range original {
+			if _, ok := current[key]; !ok {
+				missing = append(missing, key)
+			}
+		}
+		sort.Strings(missing)
+		for _, key := range missing {
+			ops = append(ops, patchOp{Op: "remove", Path: path + "/" + escapePointer(key)})
+		}
+	}
+	return ops
+}
+
+// patchOp is a single RFC 6902 JSON Patch operation. Value is raw
+// JSON so that empty values are not omitted.
+type patchOp struct {
+	Op    string          `json:"op"`
+	Path  string          `json:"path"`
+	Value json.RawMessage `json:"value,omitempty"`
+}
+
+// rawJSON encodes v, which was decoded from JSON and so always encodes.
+func rawJSON(v interface{}) json.RawMessage {
+	b, _ := json.Marshal(v)
+	return b
+}
+
+// escapePointer escapes key for use as an RFC 6901 JSON Pointer token.
+func escapePointer(key string) string {
+	return strings.NewReplacer("~", "~0", "/", "~1").Replace(key)
+}
+
+// Patch formats
+const (
+	patchMerge = "merge"
+	patchJSON  = "json-patch"
+)
@@ -0,0 +1,244 @@
+// Copyright 2021 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package form2json
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+// signSnapshot returns the signed snapshot of the JSON object original.
+func signSnapshot(key, original string) string {
+	payload := base64.RawURLEncoding.EncodeToString([]byte(original))
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(payload))
+	return payload + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func TestPatchProvision(t *testing.T) {
+	for i, tc := range []struct {
+		patch     Patch
+		expectErr bool
+	}{
+		{patch: Patch{Key: "secret"}},
+		{patch: Patch{Key: "secret", Format: patchJSON}},
+		{patch: Patch{}, expectErr: true},
+		{patch: Patch{Key: "secret", Format: "diff"}, expectErr: true},
+	} {
+		err := tc.patch.provision(caddy.NewReplacer())
+		if tc.expectErr {
+			if err == nil {
+				t.Errorf("Test %d: expected an error", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test %d: unexpected error: %v", i, err)
+			continue
+		}
+		if tc.patch.Field != "_original" || tc.patch.Format == "" {
+			t.Errorf("Test %d: expected defaults, got %+v", i, tc.patch)
+		}
+	}
+}
+
+func TestPatchSnapshot(t *testing.T) {
+	original := `{"name":"x"}`
+	for i, tc := range []struct {
+		fields    []testField
+		expectErr bool
+	}{
+		{fields: []testField{{name: "_original", value: signSnapshot("secret", original)}}},
+		{fields: []testField{{name: "_original", value: signSnapshot("secret", original) + "="}}},
+		{fields: []testField{}, expectErr: true},
+		{fields: []testField{{name: "_original", value: signSnapshot("secret", original), fileName: "o.txt"}}, expectErr: true},
+		{fields: []testField{{name: "_original", value: "eyJ9"}}, expectErr: true},
+		{fields: []testField{{name: "_original", value: signSnapshot("other", original)}}, expectErr: true},
+		{fields: []testField{{name: "_original", value: signSnapshot("secret", "[]")}}, expectErr: true},
+		{fields: []testField{{name: "_original", value: "e30.!!"}}, expectErr: true},
+	} {
+		p := Patch{Key: "secret"}
+		if err := p.provision(caddy.NewReplacer()); err != nil {
+			t.Fatal(err)
+		}
+		form, err := parseForm(newFormRequest(t, tc.fields...), defaultMemLimit, nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer form.RemoveAll()
+		snapshot, err := p.snapshot(form)
+		if len(form.parts) != 0 {
+			t.Errorf("Test %d: expected snapshot field to be removed", i)
+		}
+		if tc.expectErr {
+			if statusOf(err) != http.StatusBadRequest {
+				t.Errorf("Test %d: expected status 400, got %v", i, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test %d: unexpected error: %v", i, err)
+			continue
+		}
+		if snapshot["name"] != "x" {
+			t.Errorf("Test %d: expected snapshot %s, got %v", i, original, snapshot)
+		}
+	}
+}
+
+func TestPatchEncode(t *testing.T) {
+	for i, tc := range []struct {
+		format        string
+		removeMissing bool
+		original      map[string]interface{}
+		submitted     map[string]interface{}
+		expected      string
+	}{
+		{
+			format:    patchMerge,
+			original:  map[string]interface{}{"a": "1", "b": "2"},
+			submitted: map[string]interface{}{"a": "1", "b": "3", "c": ""},
+			expected:  `{"b":"3","c":""}`,
+		},
+		{
+			format:    patchMerge,
+			original:  map[string]interface{}{"a": "1", "b": "2"},
+			submitted: map[string]interface{}{"a": "1"},
+			expected:  `{}`,
+		},
+		{
+			format:        patchMerge,
+			removeMissing: true,
+			original:      map[string]interface{}{"a": "1", "b": "2"},
+			submitted:     map[string]interface{}{"a": "1"},
+			expected:      `{"b":null}`,
+		},
+		{
+			format:    patchMerge,
+			original:  map[string]interface{}{"addr": map[string]interface{}{"city": "x", "zip": "1"}},
+			submitted: map[string]interface{}{"addr": map[string]interface{}{"city": "y", "zip": "1"}},
+			expected:  `{"addr":{"city":"y"}}`,
+		},
+		{
+			format:    patchMerge,
+			original:  map[string]interface{}{"tags": []interface{}{"a", "b"}},
+			submitted: map[string]interface{}{"tags": []string{"a", "b"}},
+			expected:  `{}`,
+		},
+		{
+			format:    patchJSON,
+			original:  map[string]interface{}{"a": "1", "b": "2"},
+			submitted: map[string]interface{}{"a": "1"},
+			expected:  `[]`,
+		},
+		{
+			format:        patchJSON,
+			removeMissing: true,
+			original:      map[string]interface{}{"a": "1", "b": "2", "x/y": "3"},
+			submitted:     map[string]interface{}{"a": "", "c~d": "4"},
+			expected: `[{"op":"replace","path":"/a","value":""},{"op":"add","path":"/c~0d","value":"4"},` +
+				`{"op":"remove","path":"/b"},{"op":"remove","path":"/x~1y"}]`,
+		},
+		{
+			format:    patchJSON,
+			original:  map[string]interface{}{"addr": map[string]interface{}{"city": "x"}},
+			submitted: map[string]interface{}{"addr": map[string]interface{}{"city": "y", "zip": "1"}},
+			expected:  `[{"op":"replace","path":"/addr/city","value":"y"},{"op":"add","path":"/addr/zip","value":"1"}]`,
+		},
+	} {
+		p := Patch{Key: "secret", Format: tc.format, RemoveMissing: tc.removeMissing}
+		buf := new(bytes.Buffer)
+		contentType, _, err := p.encode(buf, tc.submitted, tc.original)
+		if err != nil {
+			t.Errorf("Test %d: unexpected error: %v", i, err)
+			continue
+		}
+		expectedType := "application/merge-patch+json"
+		if tc.format == patchJSON {
+			expectedType = "application/json-patch+json"
+		}
+		if contentType != expectedType {
+			t.Errorf("Test %d: expected content type %s, got %s", i, expectedType, contentType)
+		}
+		if actual := buf.String(); actual != tc.expected+"\n" {
+			t.Errorf("Test %d: expected %s, got %s", i, tc.expected, actual)
+		}
+	}
+}
+
+func TestPatchRequests(t *testing.T) {
+	snapshot := signSnapshot("secret", `{"name":"x","email":"x@example.com"}`)
+	for i, tc := range []struct {
+		format      string
+		fields      []testField
+		status      int
+		contentType string
+		expected    string
+	}{
+		{
+			fields: []testField{
+				{name: "_original", value: snapshot},
+				{name: "name", value: "y"},
+				{name: "email", value: "x@example.com"},
+			},
+			contentType: "application/merge-patch+json",
+			expected:    `{"name":"y"}`,
+		},
+		{
+			format: patchJSON,
+			fields: []testField{
+				{name: "_original", value: snapshot},
+				{name: "name", value: "y"},
+				{name: "email", value: "x@example.com"},
+			},
+			contentType: "application/json-patch+json",
+			expected:    `[{"op":"replace","path":"/name","value":"y"}]`,
+		},
+		{
+			fields: []testField{{name: "name", value: "y"}},
+			status: http.StatusBadRequest,
+		},
+	} {
+		h := newTestHandler()
+		h.Mode = modeObject
+		h.Patch = &Patch{Key: "secret", Format: tc.format}
+		if err := h.Patch.provision(caddy.NewReplacer()); err != nil {
+			t.Fatal(err)
+		}
+		_, next, err := serveTest(t, h, newFormRequest(t, tc.fields...))
+		if tc.status != 0 {
+			if statusOf(err) != tc.status {
+				t.Errorf("Test %d: expected status %d, got %v", i, tc.status, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test %d: unexpected error: %v", i, err)
+			continue
+		}
+		if actual := next.req.Header.Get("Content-Type"); actual != tc.contentType {
+			t.Errorf("Test %d: expected content type %s, got %s", i, tc.contentType, actual)
+		}
+		if actual := string(next.body); actual != tc.expected+"\n" {
+			t.Errorf("Test %d: expected %s, got %s", i, tc.expected, actual)
+		}
+	}
+}
@@ -0,0 +1,448 @@
+// Copyright 2021 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package form2json
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+// Protobuf maps the payload onto a protobuf message described by a
+// compiled descriptor set. Parts are matched to fields by their JSON or
+// proto names, like protojson does; text values are parsed according to
+// the field's type, file contents map to bytes fields, and JSON values
+// (embedded JSON parts and groups) map to message fields. Parts without
+// a matching field are ignored.
+type Protobuf struct {
+	// The path to a descriptor set file, as produced by
+	// `protoc --include_imports --descriptor_set_out`. Required.
+	DescriptorSet string `json:"descriptor_set"`
+
+	// The fully-qualified name of the message type. Optional if Method
+	// is set, in which case the method's input type is used.
+	Message string `json:"message,omitempty"`
+
+	// The full name of a unary gRPC method, e.g. "/pkg.Service/Method".
+	Method string `json:"method,omitempty"`
+
+	// If set, the message is sent to Method at this gRPC target instead
+	// of being passed to the next handler, and the method's response is
+	// written to the client as JSON. Messages are archived and published
+	// before the call, and debug echoes do not make it.
+	Target string `json:"target,omitempty"`
+
+	// If true, connect to Target without TLS.
+	Insecure bool `json:"insecure,omitempty"`
+
+	// How long to wait for gRPC calls. Default: 30s
+	Timeout caddy.Duration `json:"timeout,omitempty"`
+
+	desc     protoreflect.MessageDescriptor
+	respDesc protoreflect.MessageDescriptor
+	conn     *grpc.ClientConn
+}
+
+func (pb *Protobuf) provision() error {
+	data, err := ioutil.ReadFile(pb.DescriptorSet)
+	if err != nil {
+		return fmt.Errorf("reading descriptor set: %v", err)
+	}
+	var set descriptorpb.FileDescriptorSet
+	if err := proto.Unmarshal(data, &set); err != nil {
+		return fmt.Errorf("decoding descriptor set: %v", err)
+	}
+	files := new(protoregistry.Files)
+	for _, fdp := range set.File {
+		fd, err := protodesc.NewFile(fdp, descriptorResolver{files})
+		if err != nil {
+			return err
+		}
+		if err := files.RegisterFile(fd); err != nil {
+			return err
+		}
+	}
+
+	if pb.Method != "" {
+		md, err := findMethod(files, pb.Method)
+		if err != nil {
+			return err
+		}
+		pb.desc, pb.respDesc = md.Input(), md.Output()
+		if pb.Message != "" && protoreflect.FullName(pb.Message) != pb.desc.FullName() {
+			return fmt.Errorf("message %s is not the input type of %s", pb.Message, pb.Method)
+		}
+	} else {
+		d, err := files.FindDescriptorByName(protoreflect.FullName(pb.Message))
+		if err != nil {
+			return fmt.Errorf("message %s: %v", pb.Message, err)
+		}
+		md, ok := d.(protoreflect.MessageDescriptor)
+		if !ok {
+			return fmt.Errorf("%s is not a message", pb.Message)
+		}
+		pb.desc = md
+	}
+
+	if pb.Target == "" {
+		return nil
+	}
+	if pb.Method == "" {
+		return fmt.Errorf("a method is required to call %s", pb.Target)
+	}
+	if pb.Timeout <= 0 {
+		pb.Timeout = caddy.Duration(defaultGRPCTimeout)
+	}
+	creds := grpc.WithTransportCredentials(credentials.NewTLS(new(tls.Config)))
+	if pb.Insecure {
+		creds = grpc.WithInsecure()
+	}
+	pb.conn, err = grpc.Dial(pb.Target, creds)
+	return err
+}
+
+func (pb *Protobuf) cleanup() error {
+	if pb.conn != nil {
+		return pb.conn.Close()
+	}
+	return nil
+}
+
+// findMethod returns the unary method with the given full name, of the
+// form "/pkg.Service/Method".
+func findMethod(files *protoregistry.Files, name string) (protoreflect.MethodDescriptor, error) {
+	parts := strings.Split(strings.TrimPrefix(name, "/"), "/")
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("malformed method name: %s", name)
+	}
+	d, err := files.FindDescriptorByName(protoreflect.FullName(parts[0]))
+	if err != nil {
+		return nil, fmt.Errorf("service %s: %v", parts[0], err)
+	}
+	sd, ok := d.(protoreflect.ServiceDescriptor)
+	if !ok {
+		return nil, fmt.Errorf("%s is not a service", parts[0])
+	}
+	md := sd.Methods().ByName(protoreflect.Name(parts[1]))
+	if md == nil {
+		return nil, fmt.Errorf("service %s has no method %s", parts[0], parts[1])
+	}
+	if md.IsStreamingClient() || md.IsStreamingServer() {
+		return nil, fmt.Errorf("method %s is not unary", name)
+	}
+	return md, nil
+}
+
+// encode writes the converted parts to buf as a binary protobuf message,
+// returning its Content-Type and Content-Type-Class.
+func (pb *Protobuf) encode(buf *bytes.Buffer, converted []part) (string, string, error) {
+	msg, err := pb.buildMessage(converted)
+	if err != nil {
+		return "", "", err
+	}
+	data, err := proto.Marshal(msg)
+	if err != nil {
+		return "", "", caddyhttp.Error(http.StatusInternalServerError, err)
+	}
+	buf.Write(data)
+	return "application/x-protobuf; messageType=" + string(pb.desc.FullName()), "caddy_post_protobuf_v1", nil
+}
+
+// serveCall calls the configured gRPC method with the encoded message
+// payload and writes its response to w as JSON.
+func (pb *Protobuf) serveCall(w http.ResponseWriter, r *http.Request, payload []byte) error {
+	req := dynamicpb.NewMessage(pb.desc)
+	if err := proto.Unmarshal(payload, req); err != nil {
+		return caddyhttp.Error(http.StatusInternalServerError, err)
+	}
+	resp := dynamicpb.NewMessage(pb.respDesc)
+
+	ctx, cancel := context.WithTimeout(r.Context(), time.Duration(pb.Timeout))
+	defer cancel()
+	err := pb.conn.Invoke(ctx, pb.Method, req, resp, grpc.ForceCodec(protoCodec{}))
+	if err != nil {
+		return caddyhttp.Error(grpcHTTPStatus(status.Code(err)), err)
+	}
+
+	out, err := protojson.Marshal(resp)
+	if err != nil {
+		return caddyhttp.Error(http.StatusInternalServerError, err)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, err = w.Write(out)
+	return err
+}
+
+// buildMessage maps the converted parts onto a new message.
+func (pb *Protobuf) buildMessage(converted []part) (*dynamicpb.Message, error) {
+	msg := dynamicpb.NewMessage(pb.desc)
+	m := msg.ProtoReflect()
+	fields := pb.desc.Fields()
+	for _, p := range converted {
+		fd := findField(fields, p.Name)
+		if fd == nil {
+			continue
+		}
+		if err := setField(m, fd, p); err != nil {
+			return nil, caddyhttp.Error(http.StatusBadRequest, fieldError{
+				Field:   p.Name,
+				Message: err.Error(),
+			})
+		}
+	}
+	return msg, nil
+}
+
+// findField returns the field with the given proto or JSON name.
+func findField(fields protoreflect.FieldDescriptors, name string) protoreflect.FieldDescriptor {
+	if fd := fields.ByName(protoreflect.Name(name)); fd != nil {
+		return fd
+	}
+	for i := 0; i < fields.Len(); i++ {
+		if fd := fields.Get(i); fd.JSONName() == name {
+			return fd
+		}
+	}
+	return nil
+}
+
+// setField sets (or, for repeated fields, appends to) fd of m from p.
+func setField(m protoreflect.Message, fd protoreflect.FieldDescriptor, p part) error {
+	if fd.IsMap() {
+		return fmt.Errorf("map fields are not supported")
+	}
+	if fd.Kind() == protoreflect.MessageKind || fd.Kind() == protoreflect.GroupKind {
+		raw, err := p.jsonValue()
+		if err != nil {
+			return err
+		}
+		if raw == nil || strings.HasPrefix(p.Type, "file") {
+			return fmt.Errorf("message fields require a JSON value")
+		}
+		unmarshal := protojson.UnmarshalOptions{DiscardUnknown: true}.Unmarshal
+		if !fd.IsList() {
+			v := m.NewField(fd)
+			if err := unmarshal(raw, v.Message().Interface()); err != nil {
+				return err
+			}
+			m.Set(fd, v)
+			return nil
+		}
+		// a JSON array (such as a group) provides several elements
+		var elems []json.RawMessage
+		if err := json.Unmarshal(raw, &elems); err != nil {
+			elems = []json.RawMessage{raw}
+		}
+		list := m.Mutable(fd).List()
+		for _, elem := range elems {
+			v := list.NewElement()
+			if err := unmarshal(elem, v.Message().Interface()); err != nil {
+				return err
+			}
+			list.Append(v)
+		}
+		return nil
+	}
+
+	v, err := scalarValue(fd, p)
+	if err != nil {
+		return err
+	}
+	if fd.IsList() {
+		m.Mutable(fd).List().Append(v)
+	} else {
+		m.Set(fd, v)
+	}
+	return nil
+}
+
+// scalarValue returns the value of p as the scalar type of fd.
+func scalarValue(fd protoreflect.FieldDescriptor, p part) (protoreflect.Value, error) {
+	if strings.HasPrefix(p.Type, "file") {
+		if fd.Kind() != protoreflect.BytesKind {
+			return protoreflect.Value{}, fmt.Errorf("files can only be mapped to bytes fields")
+		}
+		if p.src == nil {
+			return protoreflect.Value{}, fmt.Errorf("file contents are not available")
+		}
+		data, err := p.src.contents()
+		return protoreflect.ValueOfBytes(data), err
+	}
+
+	s := p.Value
+	if raw, err := p.jsonValue(); err != nil {
+		return protoreflect.Value{}, err
+	} else if raw != nil {
+		s = string(raw)
+	}
+	switch fd.Kind() {
+	case protoreflect.StringKind:
+		return protoreflect.ValueOfString(s), nil
+	case protoreflect.BytesKind:
+		return protoreflect.ValueOfBytes([]byte(s)), nil
+	}
+
+	s = strings.TrimSpace(s)
+	var v protoreflect.Value
+	var err error
+	switch fd.Kind() {
+	case protoreflect.BoolKind:
+		var b bool
+		b, err = parseFormBool(s)
+		v = protoreflect.ValueOfBool(b)
+	case protoreflect.EnumKind:
+		if ev := fd.Enum().Values().ByName(protoreflect.Name(s)); ev != nil {
+			return protoreflect.ValueOfEnum(ev.Number()), nil
+		}
+		var n int64
+		n, err = strconv.ParseInt(s, 10, 32)
+		v = protoreflect.ValueOfEnum(protoreflect.EnumNumber(n))
+	case protoreflect.Int32Kind, protoreflect.Sint32Kind, protoreflect.Sfixed32Kind:
+		var n int64
+		n, err = strconv.ParseInt(s, 10, 32)
+		v = protoreflect.ValueOfInt32(int32(n))
+	case protoreflect.Int64Kind, protoreflect.Sint64Kind, protoreflect.Sfixed64Kind:
+		var n int64
+		n, err = strconv.ParseInt(s, 10, 64)
+		v = protoreflect.ValueOfInt64(n)
+	case protoreflect.Uint32Kind, protoreflect.Fixed32Kind:
+		var n uint64
+		n, err = strconv.ParseUint(s, 10, 32)
+		v = protoreflect.ValueOfUint32(uint32(n))
+	case protoreflect.Uint64Kind, protoreflect.Fixed64Kind:
+		var n uint64
+		n, err = strconv.ParseUint(s, 10, 64)
+		v = protoreflect.ValueOfUint64(n)
+	case protoreflect.FloatKind:
+		var f float64
+		f, err = strconv.ParseFloat(s, 32)
+		v = protoreflect.ValueOfFloat32(float32(f))
+	case protoreflect.DoubleKind:
+		var f float64
+		f, err = strconv.ParseFloat(s, 64)
+		v = protoreflect.ValueOfFloat64(f)
+	default:
+		err = fmt.Errorf("unsupported field kind: %v", fd.Kind())
+	}
+	return v, err
+}
+
+// jsonValue returns the JSON value of p, for embedded JSON parts and
+// groups, or nil if it has none.
+func (p part) jsonValue() (json.RawMessage, error) {
+	if p.rows == nil {
+		return p.RawValue, nil
+	}
+	buf := new(bytes.Buffer)
+	if err := writeValue(buf, p.rowObjects()); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// parseFormBool parses s as a boolean, accepting the values commonly
+// submitted by checkboxes and selects.
+func parseFormBool(s string) (bool, error) {
+	switch strings.ToLower(s) {
+	case "1", "true", "on", "yes":
+		return true, nil
+	case "", "0", "false", "off", "no":
+		return false, nil
+	}
+	return false, fmt.Errorf("invalid boolean: %q", s)
+}
+
+// descriptorResolver resolves dependencies of files in a descriptor set,
+// falling back to the descriptors linked into the binary (such as the
+// well-known types) if the set does not include them.
+type descriptorResolver struct {
+	files *protoregistry.Files
+}
+
+func (r descriptorResolver) FindFileByPath(path string) (protoreflect.FileDescriptor, error) {
+	if fd, err := r.files.FindFileByPath(path); err == nil {
+		return fd, nil
+	}
+	return protoregistry.GlobalFiles.FindFileByPath(path)
+}
+
+func (r descriptorResolver) FindDescriptorByName(name protoreflect.FullName) (protoreflect.Descriptor, error) {
+	if d, err := r.files.FindDescriptorByName(name); err == nil {
+		return d, nil
+	}
+	return protoregistry.GlobalFiles.FindDescriptorByName(name)
+}
+
+// protoCodec marshals gRPC messages with the protobuf v2 API, which
+// supports dynamic messages.
+type protoCodec struct{}
+
+func (protoCodec) Marshal(v interface{}) ([]byte, error) {
+	return proto.Marshal(v.(proto.Message))
+}
+
+func (protoCodec) Unmarshal(data []byte, v interface{}) error {
+	return proto.Unmarshal(data, v.(proto.Message))
+}
+
+func (protoCodec) Name() string { return "proto" }
+
+// grpcHTTPStatus maps a gRPC status code to an HTTP status code.
+func grpcHTTPStatus(code codes.Code) int {
+	switch code {
+	case codes.InvalidArgument, codes.FailedPrecondition, codes.OutOfRange:
+		return http.StatusBadRequest
+	case codes.Unauthenticated:
+		return http.StatusUnauthorized
+	case codes.PermissionDenied:
+		return http.StatusForbidden
+	case codes.NotFound:
+		return http.StatusNotFound
+	case codes.AlreadyExists, codes.Aborted:
+		return http.StatusConflict
+	case codes.ResourceExhausted:
+		return http.StatusTooManyRequests
+	case codes.Unimplemented:
+		return http.StatusNotImplemented
+	case codes.Unavailable:
+		return http.StatusServiceUnavailable
+	case codes.DeadlineExceeded:
+		return http.StatusGatewayTimeout
+	}
+	return http.StatusBadGateway
+}
+
+const defaultGRPCTimeout = 30 * time.Second
@@ -0,0 +1,342 @@
+// Copyright 2021 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package form2json
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+func TestProtobufCall(t *testing.T) {
+	srv := startUploadsServer(t)
+	h := newProtobufTestHandler(t, srv.addr)
+
+	w := httptest.NewRecorder()
+	err := h.ServeHTTP(w, newUploadRequest(t, "Hello"), unreachableHandler(t))
+	if err != nil {
+		t.Fatalf("serving request: %v", err)
+	}
+	if calls := atomic.LoadInt32(&srv.calls); calls != 1 {
+		t.Fatalf("expected 1 call, got %d", calls)
+	}
+	var receipt map[string]interface{}
+	if err := json.Unmarshal(w.Body.Bytes(), &receipt); err != nil {
+		t.Fatalf("decoding response %q: %v", w.Body.String(), err)
+	}
+	expected := map[string]interface{}{"title": "Hello", "count": 3.0, "photoSize": "5"}
+	for k, v := range expected {
+		if receipt[k] != v {
+			t.Errorf("expected %s to be %v, got %v", k, v, receipt[k])
+		}
+	}
+}
+
+func TestProtobufCallError(t *testing.T) {
+	srv := startUploadsServer(t)
+	h := newProtobufTestHandler(t, srv.addr)
+
+	err := h.ServeHTTP(httptest.NewRecorder(), newUploadRequest(t, ""), unreachableHandler(t))
+	herr, ok := err.(caddyhttp.HandlerError)
+	if !ok || herr.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected a 400 handler error, got %#v", err)
+	}
+}
+
+func TestProtobufCallDebugEcho(t *testing.T) {
+	srv := startUploadsServer(t)
+	h := newProtobufTestHandler(t, srv.addr)
+	h.DebugEcho = true
+
+	w := httptest.NewRecorder()
+	err := h.ServeHTTP(w, newUploadRequest(t, "Hello"), unreachableHandler(t))
+	if err != nil {
+		t.Fatalf("serving request: %v", err)
+	}
+	if calls := atomic.LoadInt32(&srv.calls); calls != 0 {
+		t.Fatalf("expected no calls when echoing, got %d", calls)
+	}
+	var echo debugEcho
+	if err := json.Unmarshal(w.Body.Bytes(), &echo); err != nil {
+		t.Fatalf("decoding echo: %v", err)
+	}
+	if ct := echo.Headers["Content-Type"]; ct != "application/x-protobuf; messageType=test.Upload" {
+		t.Errorf("unexpected Content-Type: %s", ct)
+	}
+}
+
+func TestProtobufCallFiles(t *testing.T) {
+	srv := startUploadsServer(t)
+	media := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ioutil.ReadAll(r.Body)
+		w.Write([]byte(`{"url":"https://media.example.com/a.png"}`))
+	}))
+	defer media.Close()
+
+	photo := strings.Repeat("x", 100000)
+	for i, tc := range []struct {
+		memoryLimit int64
+		media       bool
+	}{
+		{memoryLimit: defaultMemLimit},
+		{memoryLimit: 1024}, // spooled to disk
+		{memoryLimit: defaultMemLimit, media: true},
+		{memoryLimit: 1024, media: true},
+	} {
+		h := newProtobufTestHandler(t, srv.addr)
+		h.MemoryLimit = tc.memoryLimit
+		if tc.media {
+			h.Media = &Media{URL: media.URL}
+			if err := h.Media.provision(caddy.NewReplacer()); err != nil {
+				t.Fatal(err)
+			}
+		}
+		req := newFormRequest(t,
+			testField{name: "title", value: "Hello"},
+			testField{name: "photo", value: photo, fileName: "a.png", contentType: "image/png"})
+		w := httptest.NewRecorder()
+		if err := h.ServeHTTP(w, req, unreachableHandler(t)); err != nil {
+			t.Errorf("Test %d: unexpected error: %v", i, err)
+			continue
+		}
+		var receipt map[string]interface{}
+		if err := json.Unmarshal(w.Body.Bytes(), &receipt); err != nil {
+			t.Fatalf("Test %d: decoding response %q: %v", i, w.Body.String(), err)
+		}
+		if expected := strconv.Itoa(len(photo)); receipt["photoSize"] != expected {
+			t.Errorf("Test %d: expected photo size %s, got %v", i, expected, receipt["photoSize"])
+		}
+	}
+}
+
+func TestScalarValueFile(t *testing.T) {
+	fd, err := protodesc.NewFile(uploadsFile(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fields := fd.Messages().ByName("Upload").Fields()
+	photo, title := fields.ByName("photo"), fields.ByName("title")
+	src := &formPart{FileName: "a.png", data: []byte("hello")}
+
+	for i, tc := range []struct {
+		fd        protoreflect.FieldDescriptor
+		p         part
+		expectErr bool
+		expected  string
+	}{
+		{fd: photo, p: part{Type: "file/base64", src: src}, expected: "hello"},
+		{fd: photo, p: part{Type: "file/base64", Value: "aGVsbG8=", src: src}, expected: "hello"},
+		{fd: photo, p: part{Type: "file/remote", RawValue: []byte(`{}`), src: src}, expected: "hello"},
+		{fd: photo, p: part{Type: "file"}, expectErr: true},
+		{fd: title, p: part{Type: "file/base64", src: src}, expectErr: true},
+		{fd: photo, p: part{Type: "field/text", Value: "hi"}, expected: "hi"},
+	} {
+		v, err := scalarValue(tc.fd, tc.p)
+		if tc.expectErr {
+			if err == nil {
+				t.Errorf("Test %d: expected an error", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test %d: unexpected error: %v", i, err)
+			continue
+		}
+		if actual := string(v.Bytes()); actual != tc.expected {
+			t.Errorf("Test %d: expected %s, got %s", i, tc.expected, actual)
+		}
+	}
+}
+
+// uploadsServer is an in-process gRPC server implementing
+// test.Uploads/Send, which echoes the upload's title and count
+// along with the size of its photo.
+type uploadsServer struct {
+	addr  string
+	calls int32
+}
+
+func startUploadsServer(t *testing.T) *uploadsServer {
+	fd, err := protodesc.NewFile(uploadsFile(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	uploadDesc := fd.Messages().ByName("Upload")
+	receiptDesc := fd.Messages().ByName("Receipt")
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &uploadsServer{addr: ln.Addr().String()}
+	send := func(_ interface{}, stream grpc.ServerStream) error {
+		if method, _ := grpc.MethodFromServerStream(stream); method != "/test.Uploads/Send" {
+			return status.Errorf(codes.Unimplemented, "unknown method %s", method)
+		}
+		req := dynamicpb.NewMessage(uploadDesc)
+		if err := stream.RecvMsg(req); err != nil {
+			return err
+		}
+		atomic.AddInt32(&srv.calls, 1)
+		in := uploadDesc.Fields()
+		if req.Get(in.ByName("title")).String() == "" {
+			return status.Error(codes.InvalidArgument, "title is required")
+		}
+		resp := dynamicpb.NewMessage(receiptDesc)
+		out := receiptDesc.Fields()
+		resp.Set(out.ByName("title"), req.Get(in.ByName("title")))
+		resp.Set(out.ByName("count"), req.Get(in.ByName("count")))
+		resp.Set(out.ByName("photo_size"), protoreflect.ValueOfInt64(int64(len(req.Get(in.ByName("photo")).Bytes()))))
+		return stream.SendMsg(resp)
+	}
+	gs := grpc.NewServer(grpc.CustomCodec(testCodec{}), grpc.UnknownServiceHandler(send))
+	go gs.Serve(ln)
+	t.Cleanup(gs.Stop)
+	return srv
+}
+
+// newProtobufTestHandler returns a handler calling test.Uploads/Send
+// at addr.
+func newProtobufTestHandler(t *testing.T, addr string) Handler {
+	set, err := proto.Marshal(&descriptorpb.FileDescriptorSet{
+		File: []*descriptorpb.FileDescriptorProto{uploadsFile()},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "uploads.pb")
+	if err := ioutil.WriteFile(path, set, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	h := Handler{
+		MemoryLimit:        defaultMemLimit,
+		FileWorkers:        1,
+		SubmissionIDHeader: defaultSubmissionIDHeader,
+		Encoder:            encoderProtobuf,
+		logger:             zap.NewNop(),
+		Protobuf: &Protobuf{
+			DescriptorSet: path,
+			Method:        "/test.Uploads/Send",
+			Target:        addr,
+			Insecure:      true,
+		},
+	}
+	if err := h.Protobuf.provision(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { h.Cleanup() })
+	return h
+}
+
+// newUploadRequest returns a multipart request with the given title,
+// a count of 3 and a 5-byte photo.
+func newUploadRequest(t *testing.T, title string) *http.Request {
+	body := new(bytes.Buffer)
+	mw := multipart.NewWriter(body)
+	mw.WriteField("title", title)
+	mw.WriteField("count", "3")
+	header := make(textproto.MIMEHeader)
+	header.Set("Content-Disposition", `form-data; name="photo"; filename="a.png"`)
+	header.Set("Content-Type", "image/png")
+	fw, err := mw.CreatePart(header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fw.Write([]byte("hello"))
+	mw.Close()
+
+	req := httptest.NewRequest(http.MethodPost, "/", body)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	return req
+}
+
+// unreachableHandler fails the test if it is called.
+func unreachableHandler(t *testing.T) caddyhttp.Handler {
+	return caddyhttp.HandlerFunc(func(http.ResponseWriter, *http.Request) error {
+		t.Error("next handler called")
+		return nil
+	})
+}
+
+// uploadsFile describes the test.Uploads service.
+func uploadsFile() *descriptorpb.FileDescriptorProto {
+	field := func(name string, number int32, typ descriptorpb.FieldDescriptorProto_Type) *descriptorpb.FieldDescriptorProto {
+		return &descriptorpb.FieldDescriptorProto{
+			Name:   proto.String(name),
+			Number: proto.Int32(number),
+			Label:  descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL.Enum(),
+			Type:   typ.Enum(),
+		}
+	}
+	return &descriptorpb.FileDescriptorProto{
+		Name:    proto.String("test/uploads.proto"),
+		Package: proto.String("test"),
+		Syntax:  proto.String("proto3"),
+		MessageType: []*descriptorpb.DescriptorProto{
+			{
+				Name: proto.String("Upload"),
+				Field: []*descriptorpb.FieldDescriptorProto{
+					field("title", 1, descriptorpb.FieldDescriptorProto_TYPE_STRING),
+					field("count", 2, descriptorpb.FieldDescriptorProto_TYPE_INT32),
+					field("photo", 3, descriptorpb.FieldDescriptorProto_TYPE_BYTES),
+				},
+			},
+			{
+				Name: proto.String("Receipt"),
+				Field: []*descriptorpb.FieldDescriptorProto{
+					field("title", 1, descriptorpb.FieldDescriptorProto_TYPE_STRING),
+					field("count", 2, descriptorpb.FieldDescriptorProto_TYPE_INT32),
+					field("photo_size", 3, descriptorpb.FieldDescriptorProto_TYPE_INT64),
+				},
+			},
+		},
+		Service: []*descriptorpb.ServiceDescriptorProto{{
+			Name: proto.String("Uploads"),
+			Method: []*descriptorpb.MethodDescriptorProto{{
+				Name:       proto.String("Send"),
+				InputType:  proto.String(".test.Upload"),
+				OutputType: proto.String(".test.Receipt"),
+			}},
+		}},
+	}
+}
+
+// testCodec is protoCodec for servers, which need dynamic messages too.
+type testCodec struct{ protoCodec }
+
+func (testCodec) String() string { return "proto" }
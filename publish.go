@@ -0,0 +1,98 @@
+// Copyright 2021 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package form2json
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+// Publish delivers converted payloads to a sink of the form2json app,
+// such as a message broker, before the request is passed on.
+type Publish struct {
+	// The name of the sink.
+	Sink string `json:"sink"`
+
+	// If true, the request is not passed to the next handler once its
+	// payload is published; the client is answered with 202 (Accepted).
+	Terminal bool `json:"terminal,omitempty"`
+
+	// The maximum number of attempts to publish a payload. Default: 3
+	MaxAttempts int `json:"max_attempts,omitempty"`
+
+	// The delay before the second attempt, which doubles after each
+	// further attempt. Default: 100ms
+	RetryDelay caddy.Duration `json:"retry_delay,omitempty"`
+
+	sink Sink
+}
+
+func (p *Publish) provision(app *App) error {
+	if p.MaxAttempts <= 0 {
+		p.MaxAttempts = defaultPublishAttempts
+	}
+	if p.RetryDelay <= 0 {
+		p.RetryDelay = caddy.Duration(defaultPublishRetryDelay)
+	}
+	var err error
+	p.sink, err = app.sink(p.Sink)
+	return err
+}
+
+// publish publishes msg, retrying failed attempts, and returns a 502
+// error if all attempts fail. Handler errors of the sink, such as
+// those for invalid destinations, are returned without retrying.
+func (p *Publish) publish(ctx context.Context, msg Message) error {
+	delay := time.Duration(p.RetryDelay)
+	var err error
+	for attempt := 1; ; attempt++ {
+		if err = p.sink.Publish(ctx, msg); err == nil {
+			return nil
+		}
+		if _, ok := err.(caddyhttp.HandlerError); ok {
+			return err
+		}
+		if attempt >= p.MaxAttempts {
+			break
+		}
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return caddyhttp.Error(http.StatusBadGateway, fmt.Errorf("publishing to %s: %v", p.Sink, ctx.Err()))
+		}
+		delay *= 2
+	}
+	return caddyhttp.Error(http.StatusBadGateway, fmt.Errorf("publishing to %s: %v", p.Sink, err))
+}
+
+// messageTemplate returns s with the placeholders of the request which
+// ctx belongs to replaced, for sinks which template their destination.
+func messageTemplate(ctx context.Context, s string) string {
+	repl, ok := ctx.Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+	if !ok {
+		return s
+	}
+	return repl.ReplaceAll(s, "")
+}
+
+const (
+	defaultPublishAttempts   = 3
+	defaultPublishRetryDelay = 100 * time.Millisecond
+)
@@ -0,0 +1,63 @@
+// Copyright 2021 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package form2json
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+func TestPublishRetries(t *testing.T) {
+	for i, tc := range []struct {
+		errs     []error // returned by successive attempts
+		attempts int
+		status   int
+	}{
+		{errs: nil, attempts: 1},
+		{errs: []error{fmt.Errorf("down")}, attempts: 2},
+		{errs: []error{fmt.Errorf("down"), fmt.Errorf("down"), fmt.Errorf("down")}, attempts: 3, status: http.StatusBadGateway},
+		{errs: []error{caddyhttp.Error(http.StatusBadRequest, fmt.Errorf("invalid subject"))}, attempts: 1, status: http.StatusBadRequest},
+	} {
+		sink := &failingSink{errs: tc.errs}
+		p := &Publish{Sink: "test", MaxAttempts: 3, RetryDelay: 1, sink: sink}
+		err := p.publish(context.Background(), Message{Body: []byte("{}")})
+		if sink.attempts != tc.attempts {
+			t.Errorf("Test %d: expected %d attempts, got %d", i, tc.attempts, sink.attempts)
+		}
+		if statusOf(err) != tc.status {
+			t.Errorf("Test %d: expected status %d, got %d (%v)", i, tc.status, statusOf(err), err)
+		}
+	}
+}
+
+// failingSink returns its errors, one per attempt, then succeeds.
+type failingSink struct {
+	errs     []error
+	attempts int
+}
+
+func (s *failingSink) Publish(context.Context, Message) error {
+	s.attempts++
+	if len(s.errs) == 0 {
+		return nil
+	}
+	err := s.errs[0]
+	s.errs = s.errs[1:]
+	return err
+}
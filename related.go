@@ -0,0 +1,137 @@
+// Copyright 2021 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package form2json
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"strconv"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+// encodeRelated writes the converted parts to buf as a multipart/related
+// payload (RFC 2387), returning its Content-Type and Content-Type-Class.
+// The first part is the JSON root in the configured mode, where the value
+// of each file is a "cid:" URL referring to a later part which holds the
+// file's raw contents.
+func (h Handler) encodeRelated(buf *bytes.Buffer, converted []part) (string, string, error) {
+	mw := multipart.NewWriter(buf)
+	rootID := "root." + mw.Boundary() + "@form2json"
+
+	// refer to each file by Content-ID in the root, including the files
+	// within the rows of groups, whose objects are rebuilt to include
+	// their references
+	var files []part
+	ref := func(p *part) {
+		if p.Type != "file/related" {
+			return
+		}
+		p.Value = "cid:" + strconv.Itoa(len(files)+1) + "." + mw.Boundary() + "@form2json"
+		files = append(files, *p)
+	}
+	refs := make([]part, len(converted))
+	copy(refs, converted)
+	for i := range refs {
+		if refs[i].rows == nil {
+			ref(&refs[i])
+			continue
+		}
+		rows := make([]partGroup, len(refs[i].rows))
+		for j, row := range refs[i].rows {
+			rows[j] = partGroup{index: row.index, parts: append([]part(nil), row.parts...)}
+			for k := range rows[j].parts {
+				ref(&rows[j].parts[k])
+			}
+		}
+		group, err := h.groupPart(refs[i].Name, rows)
+		if err != nil {
+			return "", "", err
+		}
+		refs[i] = group
+	}
+
+	root := new(bytes.Buffer)
+	if h.Mode == modeObject {
+		obj, err := h.buildObject(refs)
+		if err != nil {
+			return "", "", err
+		}
+		err = encodeObject(root, obj)
+		if err != nil {
+			return "", "", err
+		}
+	} else if err := encodeParts(root, refs); err != nil {
+		return "", "", err
+	}
+	if h.CanonicalJSON {
+		canon, err := canonicalJSON(root.Bytes())
+		if err != nil {
+			return "", "", caddyhttp.Error(http.StatusInternalServerError, err)
+		}
+		root = bytes.NewBuffer(canon)
+	}
+
+	header := make(textproto.MIMEHeader)
+	header.Set("Content-Type", "application/json")
+	header.Set("Content-ID", "<"+rootID+">")
+	w, err := mw.CreatePart(header)
+	if err == nil {
+		_, err = root.WriteTo(w)
+	}
+	for i := 0; err == nil && i < len(files); i++ {
+		err = writeRelatedFile(mw, files[i])
+	}
+	if err == nil {
+		err = mw.Close()
+	}
+	if err != nil {
+		return "", "", caddyhttp.Error(http.StatusInternalServerError, err)
+	}
+
+	contentType := fmt.Sprintf(`multipart/related; type="application/json"; start="<%s>"; boundary=%s`,
+		rootID, mw.Boundary())
+	return contentType, "caddy_post_related_v1", nil
+}
+
+// writeRelatedFile writes the contents of the file part p to mw, with
+// the Content-ID its reference in the root refers to.
+func writeRelatedFile(mw *multipart.Writer, p part) error {
+	contentType := p.ContentType
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	header := make(textproto.MIMEHeader)
+	header.Set("Content-Type", contentType)
+	header.Set("Content-ID", "<"+p.Value[len("cid:"):]+">")
+	header.Set("Content-Disposition", fmt.Sprintf(`attachment; name="%s"; filename="%s"`,
+		escapeQuotes(p.Name), escapeQuotes(p.FileName)))
+
+	f, err := p.src.Open()
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	w, err := mw.CreatePart(header)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(w, f)
+	return err
+}
@@ -0,0 +1,129 @@
+// Copyright 2021 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package form2json
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/appcove/caddy-post2json/backend"
+)
+
+func TestRelated(t *testing.T) {
+	fields := []testField{
+		{name: "title", value: "Hello"},
+		{name: "photo", value: "img1", fileName: "a.png", contentType: "image/png"},
+		{name: "file_1", value: "doc", fileName: "b.txt"},
+		{name: "note_1", value: "first"},
+	}
+	for i, tc := range []struct {
+		mode     string
+		expected string
+	}{
+		{
+			expected: `[{"name":"title","type":"field/text","value":"Hello"},` +
+				`{"name":"photo","type":"file/related","value":"{cid:a.png}","content_type":"image/png","file_name":"a.png","size":4},` +
+				`{"name":"rows","type":"group","value":[{"file":{"type":"file/related","value":"{cid:b.txt}","file_name":"b.txt","size":3},"note":"first"}]}]`,
+		},
+		{
+			mode: modeObject,
+			expected: `{"photo":{"type":"file/related","value":"{cid:a.png}","content_type":"image/png","file_name":"a.png","size":4},` +
+				`"rows":[{"file":{"type":"file/related","value":"{cid:b.txt}","file_name":"b.txt","size":3},"note":"first"}],` +
+				`"title":"Hello"}`,
+		},
+	} {
+		h := newTestHandler()
+		h.Mode = tc.mode
+		h.Encoder = encoderRelated
+		rule := &GroupRule{Name: "rows", Pattern: `^(?P<key>[a-z]+)_(?P<index>\d+)$`}
+		if err := rule.provision(); err != nil {
+			t.Fatal(err)
+		}
+		h.Groups = []*GroupRule{rule}
+		_, next, err := serveTest(t, h, newFormRequest(t, fields...))
+		if err != nil {
+			t.Errorf("Test %d: unexpected error: %v", i, err)
+			continue
+		}
+		if actual := next.req.Header.Get("Content-Type-Class"); actual != "caddy_post_related_v1" {
+			t.Errorf("Test %d: expected class caddy_post_related_v1, got %s", i, actual)
+		}
+
+		next.req.Body = ioutil.NopCloser(bytes.NewReader(next.body))
+		rel, err := backend.DecodeRelated(next.req, 1<<20)
+		if err != nil {
+			t.Errorf("Test %d: decoding: %v", i, err)
+			continue
+		}
+		if len(rel.Files) != 2 {
+			t.Errorf("Test %d: expected 2 files, got %d", i, len(rel.Files))
+		}
+
+		// the root refers to each file by its Content-ID
+		root := string(rel.Root)
+		for _, want := range []struct{ fileName, contentType, data string }{
+			{"a.png", "image/png", "img1"},
+			{"b.txt", "application/octet-stream", "doc"},
+		} {
+			var ref string
+			for cid, f := range rel.Files {
+				if f.FileName == want.fileName {
+					ref = "cid:" + cid
+					if f.ContentType != want.contentType || string(f.Data) != want.data {
+						t.Errorf("Test %d: expected %s to be %s %q, got %s %q",
+							i, want.fileName, want.contentType, want.data, f.ContentType, f.Data)
+					}
+				}
+			}
+			if f, ok := rel.File(ref); !ok || f.FileName != want.fileName {
+				t.Errorf("Test %d: expected %s to resolve to %s", i, ref, want.fileName)
+			}
+			root = strings.Replace(root, ref, "{cid:"+want.fileName+"}", 1)
+		}
+		if !json.Valid(rel.Root) {
+			t.Errorf("Test %d: root is not JSON: %s", i, rel.Root)
+		}
+		if root != tc.expected+"\n" {
+			t.Errorf("Test %d: expected root:\n%s\ngot:\n%s", i, tc.expected, root)
+		}
+	}
+}
+
+func TestRelatedWithoutFiles(t *testing.T) {
+	h := newTestHandler()
+	h.Encoder = encoderRelated
+	req := newFormRequest(t, testField{name: "title", value: "Hello"})
+	_, next, err := serveTest(t, h, req)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	next.req.Body = ioutil.NopCloser(bytes.NewReader(next.body))
+	rel, err := backend.DecodeRelated(next.req, 1<<20)
+	if err != nil {
+		t.Fatalf("decoding: %v", err)
+	}
+	if expected := `[{"name":"title","type":"field/text","value":"Hello"}]` + "\n"; string(rel.Root) != expected {
+		t.Errorf("expected root %s, got %s", expected, rel.Root)
+	}
+	if len(rel.Files) != 0 {
+		t.Errorf("expected no files, got %d", len(rel.Files))
+	}
+	if _, err := backend.DecodeRelated(req, 1<<20); err == nil {
+		t.Error("expected an error decoding multipart/form-data")
+	}
+}
@@ -0,0 +1,593 @@
+// Copyright 2021 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package form2json
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+func TestAMQPSink(t *testing.T) {
+	srv := startAMQPServer(t, 1)
+	s := newTestAMQPSink(t, "amqp://form2json:secret@"+srv.addr+"/forms", "forms.contact")
+
+	msg := Message{
+		ID: "01F8MECHZX3TBDSZ7XRADM79XV",
+		Header: http.Header{
+			"Content-Type":       {"application/json"},
+			"Content-Type-Class": {"form"},
+		},
+		// larger than the frame size the server negotiates
+		Body: bytes.Repeat([]byte("0123456789"), 1000),
+	}
+	for i := 0; i < 2; i++ {
+		if err := s.Publish(context.Background(), msg); err != nil {
+			t.Fatalf("Publish %d: %v", i, err)
+		}
+	}
+
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if srv.dials != 1 {
+		t.Errorf("expected the connection to be reused, got %d dials", srv.dials)
+	}
+	if srv.credentials != "\x00form2json\x00secret" || srv.vhost != "forms" {
+		t.Errorf("unexpected credentials %q or vhost %q", srv.credentials, srv.vhost)
+	}
+	if len(srv.msgs) != 2 {
+		t.Fatalf("expected 2 messages, got %d", len(srv.msgs))
+	}
+	got := srv.msgs[1]
+	if got.exchange != "forms" || got.routingKey != "forms.contact" {
+		t.Errorf("expected exchange forms and routing key forms.contact, got %s and %s", got.exchange, got.routingKey)
+	}
+	if got.contentType != "application/json" || got.messageID != msg.ID || got.deliveryMode != 2 {
+		t.Errorf("unexpected properties: content type %q, message ID %q, delivery mode %d",
+			got.contentType, got.messageID, got.deliveryMode)
+	}
+	if len(got.headers) != 1 || got.headers["Content-Type-Class"] != "form" {
+		t.Errorf("expected only the Content-Type-Class header, got %v", got.headers)
+	}
+	if !bytes.Equal(got.body, msg.Body) {
+		t.Errorf("expected a body of %d bytes, got %d", len(msg.Body), len(got.body))
+	}
+	if got.frames != 3 {
+		t.Errorf("expected the body to be sent in 3 frames, got %d", got.frames)
+	}
+}
+
+func TestAMQPSinkConcurrent(t *testing.T) {
+	// the server confirms nothing until it has received all messages,
+	// so publishes waiting for each other time out
+	const n = 8
+	srv := startAMQPServer(t, n)
+	s := newTestAMQPSink(t, "amqp://"+srv.addr+"/", "forms.contact")
+
+	errs := make(chan error, n)
+	for i := 0; i < n; i++ {
+		go func(i int) {
+			errs <- s.Publish(context.Background(), Message{
+				ID:   "submission-" + strconv.Itoa(i),
+				Body: []byte(strconv.Itoa(i)),
+			})
+		}(i)
+	}
+	for i := 0; i < n; i++ {
+		if err := <-errs; err != nil {
+			t.Errorf("Publish: %v", err)
+		}
+	}
+}
+
+func TestAMQPSinkErrors(t *testing.T) {
+	srv := startAMQPServer(t, 1)
+	for i, tc := range []struct {
+		routingKey string
+		mandatory  bool
+		expected   string
+	}{
+		{routingKey: "rejected.contact", expected: "message rejected by broker"},
+		{routingKey: "unroutable.contact", mandatory: true, expected: "message returned by broker: NO_ROUTE"},
+		{routingKey: "closed.contact", expected: "amqp: 404 NOT_FOUND"},
+		{routingKey: "silent.contact", expected: "deadline exceeded"},
+	} {
+		s := newTestAMQPSink(t, "amqp://"+srv.addr+"/", tc.routingKey)
+		s.Mandatory = tc.mandatory
+		ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+		err := s.Publish(ctx, Message{ID: "failing-" + strconv.Itoa(i), Body: []byte("{}")})
+		cancel()
+		if err == nil || !strings.Contains(err.Error(), tc.expected) {
+			t.Errorf("Test %d: expected an error containing %q, got %v", i, tc.expected, err)
+		}
+		// failed publishes leave the sink usable
+		s.RoutingKey = "forms.contact"
+		if err := s.Publish(context.Background(), Message{ID: "ok-" + strconv.Itoa(i), Body: []byte("{}")}); err != nil {
+			t.Errorf("Test %d: publishing after the error: %v", i, err)
+		}
+	}
+
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	// a closed channel makes the next publish reconnect
+	if srv.dials != 5 {
+		t.Errorf("expected 5 dials, got %d", srv.dials)
+	}
+	if len(srv.msgs) != 4 {
+		t.Errorf("expected 4 messages, got %d", len(srv.msgs))
+	}
+}
+
+func newTestAMQPSink(t *testing.T, url, routingKey string) *AMQPSink {
+	s := &AMQPSink{
+		URL:        url,
+		Exchange:   "forms",
+		RoutingKey: routingKey,
+		Timeout:    caddy.Duration(2 * time.Second),
+	}
+	if err := s.Provision(caddy.Context{}); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Cleanup() })
+	return s
+}
+
+// amqpServer is an in-process stand-in for an AMQP 0-9-1 broker with
+// publisher confirms, with framing of its own. Messages with routing
+// keys starting with rejected. are nacked, those with unroutable. are
+// returned if they are mandatory, those with closed. close the
+// channel, and those with silent. are never confirmed; other messages
+// are acknowledged.
+type amqpServer struct {
+	addr string
+	hold int // number of messages to hold acknowledgements for
+
+	mu          sync.Mutex
+	dials       int
+	credentials string
+	vhost       string
+	msgs        []amqpTestMsg
+}
+
+type amqpTestMsg struct {
+	exchange     string
+	routingKey   string
+	mandatory    bool
+	contentType  string
+	headers      map[string]string
+	deliveryMode byte
+	messageID    string
+	header       []byte // the content header frame, as received
+	body         []byte
+	frames       int
+}
+
+// Frame types, and the methods used by the stand-in, by class and
+// method ID.
+const (
+	amqpTestFrameMethod    = 1
+	amqpTestFrameHeader    = 2
+	amqpTestFrameBody      = 3
+	amqpTestFrameHeartbeat = 8
+	amqpTestFrameEnd       = 0xCE
+
+	amqpTestStart         = 10<<16 | 10
+	amqpTestStartOk       = 10<<16 | 11
+	amqpTestTune          = 10<<16 | 30
+	amqpTestTuneOk        = 10<<16 | 31
+	amqpTestOpen          = 10<<16 | 40
+	amqpTestOpenOk        = 10<<16 | 41
+	amqpTestClose         = 10<<16 | 50
+	amqpTestCloseOk       = 10<<16 | 51
+	amqpTestChannelOpen   = 20<<16 | 10
+	amqpTestChannelOpenOk = 20<<16 | 11
+	amqpTestChannelClose  = 20<<16 | 40
+	amqpTestPublish       = 60<<16 | 40
+	amqpTestReturn        = 60<<16 | 50
+	amqpTestAck           = 60<<16 | 80
+	amqpTestNack          = 60<<16 | 120
+	amqpTestSelect        = 85<<16 | 10
+	amqpTestSelectOk      = 85<<16 | 11
+
+	// the frame size the server negotiates
+	amqpTestFrameMax = 4096
+)
+
+func startAMQPServer(t *testing.T, hold int) *amqpServer {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	srv := &amqpServer{addr: ln.Addr().String(), hold: hold}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			srv.mu.Lock()
+			srv.dials++
+			srv.mu.Unlock()
+			go srv.serve(conn)
+		}
+	}()
+	return srv
+}
+
+func (srv *amqpServer) serve(conn net.Conn) {
+	defer conn.Close()
+	c := &amqpTestConn{conn: conn, br: bufio.NewReader(conn)}
+	if err := srv.handshake(c); err != nil {
+		return
+	}
+	var tag, held uint64
+	for {
+		msg, err := srv.readMessage(c)
+		if err != nil {
+			return
+		}
+		tag++
+		var w amqpTestWriter
+		w.longlong(tag)
+		w.octet(0)
+		switch strings.SplitN(msg.routingKey, ".", 2)[0] {
+		case "rejected":
+			c.writeMethod(1, amqpTestNack, w.Bytes())
+		case "unroutable":
+			if msg.mandatory {
+				var r amqpTestWriter
+				r.short(312)
+				r.shortstr("NO_ROUTE")
+				r.shortstr(msg.exchange)
+				r.shortstr(msg.routingKey)
+				c.writeMethod(1, amqpTestReturn, r.Bytes())
+				c.writeFrame(amqpTestFrameHeader, 1, msg.header)
+				c.writeFrame(amqpTestFrameBody, 1, msg.body)
+			}
+			c.writeMethod(1, amqpTestAck, w.Bytes())
+		case "closed":
+			var r amqpTestWriter
+			r.short(404)
+			r.shortstr("NOT_FOUND - no exchange")
+			r.short(60)
+			r.short(40)
+			c.writeMethod(1, amqpTestChannelClose, r.Bytes())
+		case "silent":
+		default:
+			srv.mu.Lock()
+			srv.msgs = append(srv.msgs, msg)
+			srv.mu.Unlock()
+			// held messages are acknowledged at once
+			held++
+			if held >= uint64(srv.hold) {
+				w.Reset()
+				w.longlong(tag)
+				w.octet(1) // multiple
+				c.writeMethod(1, amqpTestAck, w.Bytes())
+				held = 0
+			}
+		}
+	}
+}
+
+// handshake opens the connection and a channel in confirm mode.
+func (srv *amqpServer) handshake(c *amqpTestConn) error {
+	var header [8]byte
+	if _, err := io.ReadFull(c.br, header[:]); err != nil {
+		return err
+	}
+	if string(header[:]) != "AMQP\x00\x00\x09\x01" {
+		return fmt.Errorf("unexpected protocol header %q", header)
+	}
+
+	var w amqpTestWriter
+	w.octet(0)
+	w.octet(9)
+	w.long(0) // no server properties
+	w.longstr([]byte("PLAIN"))
+	w.longstr([]byte("en_US"))
+	if err := c.writeMethod(0, amqpTestStart, w.Bytes()); err != nil {
+		return err
+	}
+	args, err := c.readMethod(amqpTestStartOk)
+	if err != nil {
+		return err
+	}
+	r := amqpTestReader{b: args}
+	r.longstr() // client properties
+	if r.shortstr() != "PLAIN" {
+		return fmt.Errorf("unexpected mechanism")
+	}
+	credentials := string(r.longstr())
+
+	w.Reset()
+	w.short(1)
+	w.long(amqpTestFrameMax)
+	w.short(0)
+	if err := c.writeMethod(0, amqpTestTune, w.Bytes()); err != nil {
+		return err
+	}
+	if _, err := c.readMethod(amqpTestTuneOk); err != nil {
+		return err
+	}
+	if args, err = c.readMethod(amqpTestOpen); err != nil {
+		return err
+	}
+	vhost := (&amqpTestReader{b: args}).shortstr()
+	if err := c.writeMethod(0, amqpTestOpenOk, []byte{0}); err != nil {
+		return err
+	}
+	if _, err := c.readMethod(amqpTestChannelOpen); err != nil {
+		return err
+	}
+	if err := c.writeMethod(1, amqpTestChannelOpenOk, []byte{0, 0, 0, 0}); err != nil {
+		return err
+	}
+	if _, err := c.readMethod(amqpTestSelect); err != nil {
+		return err
+	}
+	if err := c.writeMethod(1, amqpTestSelectOk, nil); err != nil {
+		return err
+	}
+
+	srv.mu.Lock()
+	srv.credentials, srv.vhost = credentials, vhost
+	srv.mu.Unlock()
+	return nil
+}
+
+// readMessage reads a published message with its content header and
+// body frames.
+func (srv *amqpServer) readMessage(c *amqpTestConn) (amqpTestMsg, error) {
+	var msg amqpTestMsg
+	args, err := c.readMethod(amqpTestPublish)
+	if err != nil {
+		return msg, err
+	}
+	r := amqpTestReader{b: args}
+	r.short()
+	msg.exchange = r.shortstr()
+	msg.routingKey = r.shortstr()
+	msg.mandatory = r.octet()&1 != 0
+
+	typ, payload, err := c.readFrame()
+	if err != nil {
+		return msg, err
+	}
+	if typ != amqpTestFrameHeader {
+		return msg, fmt.Errorf("expected a content header, got frame type %d", typ)
+	}
+	msg.header = payload
+	r = amqpTestReader{b: payload}
+	r.short()
+	r.short()
+	size := r.longlong()
+	flags := r.short()
+	if flags&(1<<15) != 0 {
+		msg.contentType = r.shortstr()
+	}
+	if flags&(1<<14) != 0 {
+		r.shortstr() // content encoding
+	}
+	if flags&(1<<13) != 0 {
+		msg.headers = r.table()
+	}
+	if flags&(1<<12) != 0 {
+		msg.deliveryMode = r.octet()
+	}
+	if flags&(1<<11) != 0 {
+		r.octet() // priority
+	}
+	for bit := uint(10); bit > 7; bit-- {
+		if flags&(1<<bit) != 0 {
+			r.shortstr() // correlation ID, reply to, expiration
+		}
+	}
+	if flags&(1<<7) != 0 {
+		msg.messageID = r.shortstr()
+	}
+
+	for uint64(len(msg.body)) < size {
+		typ, payload, err := c.readFrame()
+		if err != nil {
+			return msg, err
+		}
+		if typ != amqpTestFrameBody || len(payload) > amqpTestFrameMax-8 {
+			return msg, fmt.Errorf("unexpected body frame")
+		}
+		msg.body = append(msg.body, payload...)
+		msg.frames++
+	}
+	return msg, nil
+}
+
+// amqpTestConn reads and writes the frames of the stand-in.
+type amqpTestConn struct {
+	conn net.Conn
+	br   *bufio.Reader
+}
+
+// readFrame reads the next frame other than a heartbeat.
+func (c *amqpTestConn) readFrame() (byte, []byte, error) {
+	for {
+		var hdr [7]byte
+		if _, err := io.ReadFull(c.br, hdr[:]); err != nil {
+			return 0, nil, err
+		}
+		payload := make([]byte, binary.BigEndian.Uint32(hdr[3:])+1)
+		if _, err := io.ReadFull(c.br, payload); err != nil {
+			return 0, nil, err
+		}
+		if payload[len(payload)-1] != amqpTestFrameEnd {
+			return 0, nil, fmt.Errorf("malformed frame")
+		}
+		if hdr[0] != amqpTestFrameHeartbeat {
+			return hdr[0], payload[:len(payload)-1], nil
+		}
+	}
+}
+
+// readMethod reads the next method, which must be id, and returns its
+// arguments. If the client closes the connection, it is acknowledged
+// and an error is returned.
+func (c *amqpTestConn) readMethod(id uint32) ([]byte, error) {
+	for {
+		typ, payload, err := c.readFrame()
+		if err != nil {
+			return nil, err
+		}
+		if typ != amqpTestFrameMethod || len(payload) < 4 {
+			return nil, fmt.Errorf("expected a method, got frame type %d", typ)
+		}
+		switch got := binary.BigEndian.Uint32(payload); got {
+		case id:
+			return payload[4:], nil
+		case amqpTestClose:
+			c.writeMethod(0, amqpTestCloseOk, nil)
+			return nil, io.EOF
+		case amqpTestChannelClose + 1:
+			// the client acknowledges a closed channel
+		default:
+			return nil, fmt.Errorf("expected method %x, got %x", id, got)
+		}
+	}
+}
+
+func (c *amqpTestConn) writeMethod(channel uint16, id uint32, args []byte) error {
+	var w amqpTestWriter
+	w.long(id)
+	w.Write(args)
+	return c.writeFrame(amqpTestFrameMethod, channel, w.Bytes())
+}
+
+func (c *amqpTestConn) writeFrame(typ byte, channel uint16, payload []byte) error {
+	var w amqpTestWriter
+	w.octet(typ)
+	w.short(channel)
+	w.longstr(payload)
+	w.octet(amqpTestFrameEnd)
+	_, err := c.conn.Write(w.Bytes())
+	return err
+}
+
+// amqpTestWriter encodes the fields of frames.
+type amqpTestWriter struct {
+	bytes.Buffer
+}
+
+func (w *amqpTestWriter) octet(v byte) { w.WriteByte(v) }
+
+func (w *amqpTestWriter) short(v uint16) {
+	var b [2]byte
+	binary.BigEndian.PutUint16(b[:], v)
+	w.Write(b[:])
+}
+
+func (w *amqpTestWriter) long(v uint32) {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], v)
+	w.Write(b[:])
+}
+
+func (w *amqpTestWriter) longlong(v uint64) {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], v)
+	w.Write(b[:])
+}
+
+func (w *amqpTestWriter) shortstr(s string) {
+	w.WriteByte(byte(len(s)))
+	w.WriteString(s)
+}
+
+func (w *amqpTestWriter) longstr(b []byte) {
+	w.long(uint32(len(b)))
+	w.Write(b)
+}
+
+// amqpTestReader decodes the fields of frames. Reading past the end
+// yields zero values.
+type amqpTestReader struct {
+	b []byte
+}
+
+func (r *amqpTestReader) next(n int) []byte {
+	if n > len(r.b) {
+		n = len(r.b)
+	}
+	b := r.b[:n]
+	r.b = r.b[n:]
+	return b
+}
+
+func (r *amqpTestReader) octet() byte {
+	if b := r.next(1); len(b) == 1 {
+		return b[0]
+	}
+	return 0
+}
+
+func (r *amqpTestReader) short() uint16 {
+	var b [2]byte
+	copy(b[:], r.next(2))
+	return binary.BigEndian.Uint16(b[:])
+}
+
+func (r *amqpTestReader) long() uint32 {
+	var b [4]byte
+	copy(b[:], r.next(4))
+	return binary.BigEndian.Uint32(b[:])
+}
+
+func (r *amqpTestReader) longlong() uint64 {
+	var b [8]byte
+	copy(b[:], r.next(8))
+	return binary.BigEndian.Uint64(b[:])
+}
+
+func (r *amqpTestReader) shortstr() string {
+	return string(r.next(int(r.octet())))
+}
+
+func (r *amqpTestReader) longstr() []byte {
+	return r.next(int(r.long()))
+}
+
+// table reads a field table of long string values.
+func (r *amqpTestReader) table() map[string]string {
+	fields := amqpTestReader{b: r.longstr()}
+	t := make(map[string]string)
+	for len(fields.b) > 0 {
+		key := fields.shortstr()
+		if fields.octet() != 'S' {
+			break
+		}
+		t[key] = string(fields.longstr())
+	}
+	return t
+}
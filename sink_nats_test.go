@@ -0,0 +1,209 @@
+// Copyright 2021 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package form2json
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+)
+
+func TestNATSSink(t *testing.T) {
+	srv := startNATSServer(t)
+	s := newTestNATSSink(t, srv, "forms.contact")
+
+	msg := Message{
+		ID: "01F8MECHZX3TBDSZ7XRADM79XV",
+		Header: http.Header{
+			"Content-Type":       {"application/json"},
+			"Content-Type-Class": {"form"},
+		},
+		Body: []byte(`{"name":"Gopher"}`),
+	}
+	// a retried publish of the same submission is stored once
+	for i := 0; i < 2; i++ {
+		if err := s.Publish(context.Background(), msg); err != nil {
+			t.Fatalf("Publish %d: %v", i, err)
+		}
+	}
+
+	js := natsTestJetStream(t, srv)
+	info, err := js.StreamInfo("FORMS")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.State.Msgs != 1 {
+		t.Errorf("expected 1 stored message, got %d", info.State.Msgs)
+	}
+	got, err := js.GetMsg("FORMS", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Subject != "forms.contact" {
+		t.Errorf("expected subject forms.contact, got %s", got.Subject)
+	}
+	if string(got.Data) != string(msg.Body) {
+		t.Errorf("expected body %s, got %s", msg.Body, got.Data)
+	}
+	for field, expected := range map[string]string{
+		"Nats-Msg-Id":        msg.ID,
+		"Content-Type":       "application/json",
+		"Content-Type-Class": "form",
+	} {
+		if actual := got.Header.Get(field); actual != expected {
+			t.Errorf("expected header %s: %s, got %q", field, expected, actual)
+		}
+	}
+}
+
+func TestNATSSinkConcurrent(t *testing.T) {
+	const n = 8
+	srv := startNATSServer(t)
+	s := newTestNATSSink(t, srv, "forms.contact")
+
+	errs := make(chan error, n)
+	for i := 0; i < n; i++ {
+		go func(i int) {
+			errs <- s.Publish(context.Background(), Message{
+				ID:   "submission-" + strconv.Itoa(i),
+				Body: []byte(strconv.Itoa(i)),
+			})
+		}(i)
+	}
+	for i := 0; i < n; i++ {
+		if err := <-errs; err != nil {
+			t.Errorf("Publish: %v", err)
+		}
+	}
+
+	info, err := natsTestJetStream(t, srv).StreamInfo("FORMS")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.State.Msgs != n {
+		t.Errorf("expected %d stored messages, got %d", n, info.State.Msgs)
+	}
+}
+
+func TestNATSSinkErrors(t *testing.T) {
+	srv := startNATSServer(t)
+	for i, tc := range []struct {
+		subject  string
+		status   int
+		expected string
+	}{
+		{subject: "unbound.contact", expected: "no response from stream"},
+		{subject: "full.contact", expected: "maximum messages exceeded"},
+		{subject: "forms.*", status: http.StatusBadRequest},
+		{subject: "forms.>", status: http.StatusBadRequest},
+		{subject: "forms.contact us", status: http.StatusBadRequest},
+		{subject: "forms..contact", status: http.StatusBadRequest},
+		{subject: "forms.{form}", status: http.StatusBadRequest},
+		{subject: "forms.{form}.>", status: http.StatusBadRequest},
+	} {
+		// placeholders may expand to wildcards
+		repl := caddy.NewReplacer()
+		repl.Set("form", "*")
+		ctx := context.WithValue(context.Background(), caddy.ReplacerCtxKey, repl)
+
+		s := newTestNATSSink(t, srv, tc.subject)
+		err := s.Publish(ctx, Message{ID: strconv.Itoa(i), Body: []byte("{}")})
+		if err == nil {
+			t.Errorf("Test %d: expected an error", i)
+			continue
+		}
+		if statusOf(err) != tc.status {
+			t.Errorf("Test %d: expected status %d, got %d (%v)", i, tc.status, statusOf(err), err)
+		}
+		if !strings.Contains(err.Error(), tc.expected) {
+			t.Errorf("Test %d: expected an error containing %q, got %v", i, tc.expected, err)
+		}
+		// failed publishes leave the sink usable
+		s.Subject = "forms.contact"
+		if err := s.Publish(ctx, Message{ID: strconv.Itoa(i), Body: []byte("{}")}); err != nil {
+			t.Errorf("Test %d: publishing after the error: %v", i, err)
+		}
+	}
+}
+
+func newTestNATSSink(t *testing.T, srv *server.Server, subject string) *NATSSink {
+	s := &NATSSink{
+		URL:     srv.ClientURL(),
+		Subject: subject,
+		Timeout: caddy.Duration(2 * time.Second),
+	}
+	if err := s.Provision(caddy.Context{}); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Cleanup() })
+	return s
+}
+
+// startNATSServer starts an embedded NATS server with JetStream, with
+// a stream FORMS bound to forms.>, and a stream FULL bound to full.>
+// which is full.
+func startNATSServer(t *testing.T) *server.Server {
+	srv, err := server.NewServer(&server.Options{
+		Host:      "127.0.0.1",
+		Port:      -1,
+		NoLog:     true,
+		NoSigs:    true,
+		JetStream: true,
+		StoreDir:  t.TempDir(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Start()
+	if !srv.ReadyForConnections(5 * time.Second) {
+		t.Fatal("NATS server not ready")
+	}
+	t.Cleanup(srv.Shutdown)
+
+	js := natsTestJetStream(t, srv)
+	for _, cfg := range []*nats.StreamConfig{
+		{Name: "FORMS", Subjects: []string{"forms.>"}},
+		{Name: "FULL", Subjects: []string{"full.>"}, MaxMsgs: 1, Discard: nats.DiscardNew},
+	} {
+		if _, err := js.AddStream(cfg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := js.Publish("full.first", []byte("{}")); err != nil {
+		t.Fatal(err)
+	}
+	return srv
+}
+
+// natsTestJetStream connects to srv to inspect its streams.
+func natsTestJetStream(t *testing.T, srv *server.Server) nats.JetStreamContext {
+	nc, err := nats.Connect(srv.ClientURL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(nc.Close)
+	js, err := nc.JetStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return js
+}
@@ -0,0 +1,87 @@
+// Copyright 2021 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package form2json
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// newSubmissionID returns a new ULID (https://github.com/ulid/spec):
+// a 48-bit millisecond timestamp followed by 80 random bits, encoded
+// as 26 characters of Crockford's base32, so that IDs sort by time.
+// IDs generated within the same millisecond increment the random
+// bits, so they are also sorted within the process; if those bits
+// overflow, the timestamp is moved on by a millisecond instead.
+func newSubmissionID() (string, error) {
+	ulidMu.Lock()
+	defer ulidMu.Unlock()
+
+	ms := uint64(time.Now().UnixNano() / int64(time.Millisecond))
+	entropy := ulidEntropy
+	if ms <= ulidLastMS && incrementEntropy(entropy[:]) {
+		ulidEntropy = entropy
+		return encodeULID(ulidLastMS, ulidEntropy), nil
+	}
+	if ms <= ulidLastMS {
+		ms = ulidLastMS + 1
+	}
+	if _, err := rand.Read(entropy[:]); err != nil {
+		return "", fmt.Errorf("reading entropy for submission ID: %v", err)
+	}
+	ulidLastMS, ulidEntropy = ms, entropy
+	return encodeULID(ulidLastMS, ulidEntropy), nil
+}
+
+// incrementEntropy increments b as a big-endian number, and reports
+// false if it overflowed.
+func incrementEntropy(b []byte) bool {
+	for i := len(b) - 1; i >= 0; i-- {
+		b[i]++
+		if b[i] != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// encodeULID encodes the timestamp ms and entropy as the 128 bits of a
+// ULID, in 26 base32 characters, the first of which holds only the top
+// 3 bits.
+func encodeULID(ms uint64, entropy [10]byte) string {
+	var id [16]byte
+	binary.BigEndian.PutUint64(id[:8], ms<<16)
+	copy(id[6:], entropy[:])
+	hi := binary.BigEndian.Uint64(id[:8])
+	lo := binary.BigEndian.Uint64(id[8:])
+	var out [26]byte
+	for i := len(out) - 1; i >= 0; i-- {
+		out[i] = crockford[lo&31]
+		lo = lo>>5 | hi<<59
+		hi >>= 5
+	}
+	return string(out[:])
+}
+
+const crockford = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+var (
+	ulidMu      sync.Mutex
+	ulidLastMS  uint64
+	ulidEntropy [10]byte
+)
@@ -0,0 +1,73 @@
+// Copyright 2021 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package form2json
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestNewSubmissionID(t *testing.T) {
+	// IDs generated within one millisecond are ordered
+	prev, err := newSubmissionID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 1000; i++ {
+		id, err := newSubmissionID()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(id) != 26 || id <= prev {
+			t.Fatalf("Test %d: expected an ID after %s, got %s", i, prev, id)
+		}
+		prev = id
+	}
+
+	// when the entropy of a millisecond is used up, IDs move on to the
+	// next one, even if it has not come yet
+	ulidMu.Lock()
+	ulidLastMS += 60000
+	ms := ulidLastMS
+	copy(ulidEntropy[:], bytes.Repeat([]byte{0xff}, len(ulidEntropy)))
+	last := encodeULID(ulidLastMS, ulidEntropy)
+	ulidMu.Unlock()
+	id, err := newSubmissionID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id <= last {
+		t.Errorf("expected an ID after %s, got %s", last, id)
+	}
+	if ulidLastMS != ms+1 {
+		t.Errorf("expected timestamp %d, got %d", ms+1, ulidLastMS)
+	}
+}
+
+func TestEncodeULID(t *testing.T) {
+	for i, tc := range []struct {
+		ms       uint64
+		entropy  [10]byte
+		expected string
+	}{
+		{expected: "00000000000000000000000000"},
+		{ms: 1<<48 - 1, entropy: [10]byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}, expected: "7ZZZZZZZZZZZZZZZZZZZZZZZZZ"},
+		{ms: 1469918176385, expected: "01ARYZ6S410000000000000000"},
+	} {
+		if actual := encodeULID(tc.ms, tc.entropy); actual != tc.expected {
+			t.Errorf("Test %d: expected %s, got %s", i, tc.expected, actual)
+		}
+	}
+}
@@ -0,0 +1,329 @@
+// Copyright 2021 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package form2json
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// UploadGuard protects against clients which send form payloads
+// too slowly, or stop sending them altogether, while holding memory
+// and temporary files. Uploads which violate a limit, or which the
+// client abandons, are aborted with a 408 (Request Timeout) error
+// describing the limit or the disconnect. HTTP/1 connections whose
+// body is still being sent are closed after a bare 408 response, as
+// the rest of the body cannot be waited for; the error is then not
+// passed to error routes, but is still counted in metrics.
+type UploadGuard struct {
+	// The minimum average upload rate in bytes per second, enforced
+	// once MinRateGrace has elapsed. Default: no minimum
+	MinRate int64 `json:"min_rate,omitempty"`
+
+	// How long an upload may run before MinRate is enforced.
+	// Default: 5s
+	MinRateGrace caddy.Duration `json:"min_rate_grace,omitempty"`
+
+	// The maximum time to receive the headers of the first multipart
+	// part. Default: no limit
+	HeaderTimeout caddy.Duration `json:"header_timeout,omitempty"`
+
+	// The maximum time to receive the entire payload. Default: no limit
+	BodyTimeout caddy.Duration `json:"body_timeout,omitempty"`
+
+	// The maximum time to receive the contents of any single multipart
+	// part. Default: no limit
+	PartTimeout caddy.Duration `json:"part_timeout,omitempty"`
+
+	interval time.Duration
+}
+
+func (u *UploadGuard) provision() {
+	if u.MinRateGrace <= 0 {
+		u.MinRateGrace = caddy.Duration(defaultMinRateGrace)
+	}
+
+	// check limits often enough to enforce the shortest of them
+	// with reasonable precision
+	u.interval = time.Second
+	for _, d := range []caddy.Duration{u.HeaderTimeout, u.BodyTimeout, u.PartTimeout} {
+		if d > 0 && time.Duration(d)/4 < u.interval {
+			u.interval = time.Duration(d) / 4
+		}
+	}
+	if u.interval < minGuardInterval {
+		u.interval = minGuardInterval
+	}
+}
+
+// watch replaces the body of r with one which is read from the client
+// in the background and aborted as soon as a limit is violated or the
+// client disconnects. The returned watch must be stopped once the body
+// has been read.
+func (u *UploadGuard) watch(r *http.Request) *uploadWatch {
+	pr, pw := io.Pipe()
+	uw := &uploadWatch{
+		guard: u,
+		body:  r.Body,
+		pr:    pr,
+		pw:    pw,
+		start: time.Now(),
+		stopc: make(chan struct{}),
+		done:  make(chan struct{}),
+	}
+	r.Body = uw
+	go uw.copy()
+	go uw.monitor(r.Context())
+	return uw
+}
+
+// uploadWatch enforces the limits of an UploadGuard on one request body.
+type uploadWatch struct {
+	guard *UploadGuard
+	body  io.ReadCloser
+	pr    *io.PipeReader
+	pw    *io.PipeWriter
+	start time.Time
+
+	mu        sync.Mutex
+	received  int64
+	headers   bool      // true once the first part headers are received
+	partStart time.Time // zero unless a part is being received
+	partName  string
+	err       error
+
+	stopc    chan struct{}
+	stopOnce sync.Once
+	done     chan struct{} // closed once the client body is finished with
+}
+
+// copy reads the client body into the pipe read by the form parser.
+func (uw *uploadWatch) copy() {
+	defer close(uw.done)
+	_, err := io.Copy(uw.pw, countingReader{uw.body, uw})
+	if err == io.ErrUnexpectedEOF {
+		// the client closed the connection before sending the whole body
+		uw.abort(uploadClientGone, caddyhttp.Error(http.StatusRequestTimeout,
+			fmt.Errorf("client disconnected during upload")))
+	}
+	uw.pw.CloseWithError(err)
+}
+
+// monitor periodically checks the limits until the watch is stopped.
+func (uw *uploadWatch) monitor(ctx context.Context) {
+	ticker := time.NewTicker(uw.guard.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-uw.stopc:
+			return
+		case <-ctx.Done():
+			uw.abort(uploadClientGone, caddyhttp.Error(http.StatusRequestTimeout,
+				fmt.Errorf("client disconnected during upload")))
+			return
+		case now := <-ticker.C:
+			if reason, err := uw.check(now); err != nil {
+				uw.abort(reason, caddyhttp.Error(http.StatusRequestTimeout, err))
+				return
+			}
+		}
+	}
+}
+
+// check returns the reason and error for the first limit violated at now.
+func (uw *uploadWatch) check(now time.Time) (string, error) {
+	u := uw.guard
+	uw.mu.Lock()
+	defer uw.mu.Unlock()
+
+	elapsed := now.Sub(uw.start)
+	if u.HeaderTimeout > 0 && !uw.headers && elapsed > time.Duration(u.HeaderTimeout) {
+		return uploadHeaderTimeout, fmt.Errorf("timed out waiting for form part headers")
+	}
+	if u.BodyTimeout > 0 && elapsed > time.Duration(u.BodyTimeout) {
+		return uploadBodyTimeout, fmt.Errorf("timed out receiving form payload")
+	}
+	if u.PartTimeout > 0 && !uw.partStart.IsZero() && now.Sub(uw.partStart) > time.Duration(u.PartTimeout) {
+		return uploadPartTimeout, fmt.Errorf("timed out receiving form part %q", uw.partName)
+	}
+	if u.MinRate > 0 && elapsed > time.Duration(u.MinRateGrace) &&
+		float64(uw.received)/elapsed.Seconds() < float64(u.MinRate) {
+		return uploadMinRate, fmt.Errorf("form payload received below minimum rate of %d bytes/s", u.MinRate)
+	}
+	return "", nil
+}
+
+// abort fails the upload with err, unless it has already been stopped.
+func (uw *uploadWatch) abort(reason string, err error) {
+	uw.mu.Lock()
+	defer uw.mu.Unlock()
+	select {
+	case <-uw.stopc:
+		return
+	default:
+	}
+	if uw.err != nil {
+		return
+	}
+	uw.err = err
+	uploadAborts.WithLabelValues(reason).Inc()
+	uw.pw.CloseWithError(err)
+}
+
+// Err returns the error the upload was aborted with, if any.
+func (uw *uploadWatch) Err() error {
+	if uw == nil {
+		return nil
+	}
+	uw.mu.Lock()
+	defer uw.mu.Unlock()
+	return uw.err
+}
+
+// headersReceived records that the headers of the first part have
+// been received.
+func (uw *uploadWatch) headersReceived() {
+	if uw == nil {
+		return
+	}
+	uw.mu.Lock()
+	uw.headers = true
+	uw.mu.Unlock()
+}
+
+// partStarted records that the contents of the named part are being
+// received.
+func (uw *uploadWatch) partStarted(name string) {
+	if uw == nil {
+		return
+	}
+	uw.mu.Lock()
+	uw.headers = true
+	uw.partStart = time.Now()
+	uw.partName = name
+	uw.mu.Unlock()
+}
+
+// partDone records that the contents of a part have been received.
+func (uw *uploadWatch) partDone() {
+	if uw == nil {
+		return
+	}
+	uw.mu.Lock()
+	uw.partStart = time.Time{}
+	uw.mu.Unlock()
+}
+
+// reject responds to the aborted upload with err, which is returned
+// for the handler to return. The background copy may still be blocked
+// reading the body from a stalled client, which net/http would wait for
+// once the handler returns. So unless the copy is done, HTTP/1
+// connections are taken over to send the response, and closed, which
+// ends the read; nil is returned then, since the response is written.
+// Other protocols end the read themselves once the handler returns.
+func (uw *uploadWatch) reject(w http.ResponseWriter, err error) error {
+	w.Header().Set("Connection", "close")
+	select {
+	case <-uw.done:
+		return err
+	default:
+	}
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		return err
+	}
+	conn, brw, hjErr := hj.Hijack()
+	if hjErr != nil {
+		return err
+	}
+	defer conn.Close()
+	status := http.StatusRequestTimeout
+	if herr, ok := err.(caddyhttp.HandlerError); ok && herr.StatusCode != 0 {
+		status = herr.StatusCode
+	}
+	fmt.Fprintf(brw, "HTTP/1.1 %d %s\r\nConnection: close\r\nContent-Length: 0\r\n\r\n",
+		status, http.StatusText(status))
+	brw.Flush()
+	return nil
+}
+
+// Read reads the client body as received by the background copy.
+func (uw *uploadWatch) Read(p []byte) (int, error) {
+	return uw.pr.Read(p)
+}
+
+// Close stops the watch. The client body is only closed if it is no
+// longer being read; a body blocked on a stalled client is left to be
+// ended by reject.
+func (uw *uploadWatch) Close() error {
+	uw.stopOnce.Do(func() {
+		uw.mu.Lock()
+		close(uw.stopc)
+		uw.mu.Unlock()
+		uw.pr.Close()
+	})
+	select {
+	case <-uw.done:
+		return uw.body.Close()
+	default:
+		return nil
+	}
+}
+
+// countingReader counts the bytes received by an uploadWatch.
+type countingReader struct {
+	r  io.Reader
+	uw *uploadWatch
+}
+
+func (cr countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	if n > 0 {
+		cr.uw.mu.Lock()
+		cr.uw.received += int64(n)
+		cr.uw.mu.Unlock()
+	}
+	return n, err
+}
+
+// Reasons for which uploads are aborted, as reported in metrics.
+const (
+	uploadHeaderTimeout = "header_timeout"
+	uploadBodyTimeout   = "body_timeout"
+	uploadPartTimeout   = "part_timeout"
+	uploadMinRate       = "min_rate"
+	uploadClientGone    = "client_disconnect"
+)
+
+var uploadAborts = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "caddy",
+	Subsystem: "form2json",
+	Name:      "upload_aborts_total",
+	Help:      "Form uploads aborted by the upload guard, by reason.",
+}, []string{"reason"})
+
+const (
+	defaultMinRateGrace = 5 * time.Second
+	minGuardInterval    = 10 * time.Millisecond
+)
@@ -0,0 +1,169 @@
+// Copyright 2021 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package form2json
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// guardedUpload is the start of a multipart body, up to the contents
+// of a file part.
+const guardedUpload = "--b\r\n" +
+	`Content-Disposition: form-data; name="doc"; filename="a.txt"` + "\r\n\r\n" +
+	"contents"
+
+func TestUploadGuard(t *testing.T) {
+	for i, tc := range []struct {
+		guard UploadGuard
+		// send writes the body of a request with a Content-Length of
+		// 1 MB, of which it sends less
+		send   func(conn net.Conn)
+		reason string
+	}{
+		{
+			guard:  UploadGuard{HeaderTimeout: caddy.Duration(100 * time.Millisecond)},
+			send:   func(conn net.Conn) {},
+			reason: uploadHeaderTimeout,
+		},
+		{
+			guard: UploadGuard{PartTimeout: caddy.Duration(100 * time.Millisecond)},
+			send: func(conn net.Conn) {
+				io.WriteString(conn, guardedUpload)
+			},
+			reason: uploadPartTimeout,
+		},
+		{
+			guard: UploadGuard{BodyTimeout: caddy.Duration(200 * time.Millisecond)},
+			send: func(conn net.Conn) {
+				// a byte at a time, until the connection is closed
+				go func() {
+					io.WriteString(conn, guardedUpload)
+					for {
+						time.Sleep(20 * time.Millisecond)
+						if _, err := conn.Write([]byte("x")); err != nil {
+							return
+						}
+					}
+				}()
+			},
+			reason: uploadBodyTimeout,
+		},
+		{
+			guard: UploadGuard{MinRate: 1 << 20, MinRateGrace: caddy.Duration(100 * time.Millisecond)},
+			send: func(conn net.Conn) {
+				io.WriteString(conn, guardedUpload)
+			},
+			reason: uploadMinRate,
+		},
+		{
+			guard: UploadGuard{BodyTimeout: caddy.Duration(time.Minute)},
+			send: func(conn net.Conn) {
+				io.WriteString(conn, guardedUpload)
+				conn.(*net.TCPConn).CloseWrite()
+			},
+			reason: uploadClientGone,
+		},
+	} {
+		aborts := testutil.ToFloat64(uploadAborts.WithLabelValues(tc.reason))
+
+		h := newTestHandler()
+		guard := tc.guard
+		guard.provision()
+		h.UploadGuard = &guard
+		srv, served := newGuardedServer(t, h)
+
+		conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		fmt.Fprintf(conn, "POST / HTTP/1.1\r\nHost: example.com\r\n"+
+			"Content-Type: multipart/form-data; boundary=b\r\nContent-Length: %d\r\n\r\n", 1<<20)
+		tc.send(conn)
+
+		// the client gets a 408, and then its connection is closed
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		br := bufio.NewReader(conn)
+		resp, err := http.ReadResponse(br, nil)
+		if err != nil {
+			t.Errorf("Test %d: reading response: %v", i, err)
+		} else if resp.StatusCode != http.StatusRequestTimeout {
+			t.Errorf("Test %d: expected status 408, got %d", i, resp.StatusCode)
+		}
+		if _, err := io.Copy(ioutil.Discard, br); err != nil {
+			t.Errorf("Test %d: expected connection to be closed, got %v", i, err)
+		}
+		conn.Close()
+
+		// and the handler is not held up by the unread body
+		select {
+		case <-served:
+		case <-time.After(5 * time.Second):
+			t.Errorf("Test %d: handler did not return", i)
+		}
+		srv.Close()
+
+		if actual := testutil.ToFloat64(uploadAborts.WithLabelValues(tc.reason)) - aborts; actual != 1 {
+			t.Errorf("Test %d: expected 1 abort for %s, got %v", i, tc.reason, actual)
+		}
+	}
+}
+
+func TestUploadGuardPasses(t *testing.T) {
+	h := newTestHandler()
+	h.Mode = modeObject
+	h.UploadGuard = &UploadGuard{
+		MinRate:       1,
+		HeaderTimeout: caddy.Duration(time.Minute),
+		BodyTimeout:   caddy.Duration(time.Minute),
+		PartTimeout:   caddy.Duration(time.Minute),
+	}
+	h.UploadGuard.provision()
+	_, next, err := serveTest(t, h, newFormRequest(t, testField{name: "doc", value: "contents", fileName: "a.txt"}))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !next.called {
+		t.Error("expected the next handler to be called")
+	}
+}
+
+// newGuardedServer returns a server for h, which writes the status of
+// handler errors like Caddy does when there are no error routes, and
+// a channel receiving a value whenever the handler returns.
+func newGuardedServer(t *testing.T, h Handler) (*httptest.Server, <-chan struct{}) {
+	served := make(chan struct{}, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() { served <- struct{}{} }()
+		if err := h.ServeHTTP(w, r, new(upstream)); err != nil {
+			if status := statusOf(err); status != 0 {
+				w.WriteHeader(status)
+				return
+			}
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	return srv, served
+}
@@ -0,0 +1,108 @@
+// Copyright 2021 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package form2json
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+// validateOnlyRequested returns true if the headers of r ask for the
+// form to be validated only.
+func (h Handler) validateOnlyRequested(r *http.Request) bool {
+	if h.ValidateOnlyHeader != "" && r.Header.Get(h.ValidateOnlyHeader) != "" {
+		return true
+	}
+	return preferValidateOnly(r)
+}
+
+// preferValidateOnly returns true if r has a Prefer header (RFC 7240)
+// with the handling=validate-only preference.
+func preferValidateOnly(r *http.Request) bool {
+	for _, field := range r.Header.Values("Prefer") {
+		for _, pref := range strings.Split(field, ",") {
+			// ignore any preference parameters
+			if i := strings.Index(pref, ";"); i >= 0 {
+				pref = pref[:i]
+			}
+			kv := strings.SplitN(pref, "=", 2)
+			if len(kv) != 2 || !strings.EqualFold(strings.TrimSpace(kv[0]), "handling") {
+				continue
+			}
+			if strings.EqualFold(strings.Trim(strings.TrimSpace(kv[1]), `"`), "validate-only") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// writeValidation writes the outcome of converting the form to w. Client
+// errors encountered while converting are reported as validation errors;
+// server errors are returned as-is.
+func (h Handler) writeValidation(w http.ResponseWriter, r *http.Request, converted []part, err error) error {
+	result := validation{Valid: true, Parts: converted}
+	if err != nil {
+		herr, ok := err.(caddyhttp.HandlerError)
+		if !ok || herr.StatusCode >= http.StatusInternalServerError {
+			return err
+		}
+		result = validation{Errors: []fieldError{asFieldError(herr.Err)}}
+	}
+
+	if preferValidateOnly(r) {
+		w.Header().Set("Preference-Applied", "handling=validate-only")
+	}
+	w.Header().Add("Vary", "Prefer")
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if !result.Valid {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+	}
+	return json.NewEncoder(w).Encode(result)
+}
+
+// validation is the response body for validate-only requests.
+type validation struct {
+	Valid  bool         `json:"valid"`
+	Parts  []part       `json:"parts,omitempty"`
+	Errors []fieldError `json:"errors,omitempty"`
+}
+
+// fieldError is a client error, optionally attributable to a single
+// form field. Handlers should wrap it with a 4xx caddyhttp.Error so
+// it is reported in validate-only responses.
+type fieldError struct {
+	Field   string `json:"field,omitempty"`
+	Message string `json:"message"`
+}
+
+func (e fieldError) Error() string {
+	if e.Field == "" {
+		return e.Message
+	}
+	return e.Field + ": " + e.Message
+}
+
+// asFieldError returns err as a fieldError.
+func asFieldError(err error) fieldError {
+	if ferr, ok := err.(fieldError); ok {
+		return ferr
+	}
+	return fieldError{Message: err.Error()}
+}
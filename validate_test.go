@@ -0,0 +1,117 @@
+// Copyright 2021 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package form2json
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestPreferValidateOnly(t *testing.T) {
+	for i, tc := range []struct {
+		prefer   []string
+		expected bool
+	}{
+		{prefer: nil, expected: false},
+		{prefer: []string{"handling=validate-only"}, expected: true},
+		{prefer: []string{`Handling="Validate-Only"`}, expected: true},
+		{prefer: []string{"respond-async, handling=validate-only; foo=bar"}, expected: true},
+		{prefer: []string{"respond-async", "handling=validate-only"}, expected: true},
+		{prefer: []string{"handling=lenient"}, expected: false},
+		{prefer: []string{"validate-only"}, expected: false},
+		{prefer: []string{"return=minimal; handling=validate-only"}, expected: false},
+	} {
+		r := httptest.NewRequest(http.MethodPost, "/", nil)
+		for _, v := range tc.prefer {
+			r.Header.Add("Prefer", v)
+		}
+		if actual := preferValidateOnly(r); actual != tc.expected {
+			t.Errorf("Test %d: expected %t, got %t", i, tc.expected, actual)
+		}
+	}
+}
+
+func TestValidateOnly(t *testing.T) {
+	photo := testField{name: "photo", value: "hello", fileName: "a.png", contentType: "image/png"}
+	for i, tc := range []struct {
+		header        string
+		field         bool
+		validateFiles bool
+		maxFileSize   int64
+		status        int
+		fileValue     string
+	}{
+		{header: "Prefer", status: http.StatusOK},
+		{header: "Form2json-Validate", status: http.StatusOK},
+		{field: true, status: http.StatusOK},
+		{header: "Prefer", validateFiles: true, status: http.StatusOK, fileValue: "aGVsbG8="},
+		{header: "Prefer", maxFileSize: 4, status: http.StatusUnprocessableEntity},
+	} {
+		h := newTestHandler()
+		h.ValidateOnlyHeader = "Form2json-Validate"
+		h.ValidateOnlyField = "_validate"
+		h.ValidateFiles = tc.validateFiles
+		h.MaxFileSize = tc.maxFileSize
+
+		fields := []testField{{name: "title", value: "Hello"}, photo}
+		if tc.field {
+			fields = append(fields, testField{name: "_validate", value: "1"})
+		}
+		req := newFormRequest(t, fields...)
+		switch tc.header {
+		case "Prefer":
+			req.Header.Set("Prefer", "handling=validate-only")
+		case "":
+		default:
+			req.Header.Set(tc.header, "1")
+		}
+
+		w, next, err := serveTest(t, h, req)
+		if err != nil {
+			t.Errorf("Test %d: unexpected error: %v", i, err)
+			continue
+		}
+		if next.called {
+			t.Errorf("Test %d: next handler called", i)
+		}
+		if w.Code != tc.status {
+			t.Errorf("Test %d: expected status %d, got %d", i, tc.status, w.Code)
+		}
+		if applied := w.Header().Get("Preference-Applied"); (tc.header == "Prefer") != (applied == "handling=validate-only") {
+			t.Errorf("Test %d: unexpected Preference-Applied header %q", i, applied)
+		}
+
+		var result validation
+		if err := json.Unmarshal(w.Body.Bytes(), &result); err != nil {
+			t.Errorf("Test %d: decoding result: %v", i, err)
+			continue
+		}
+		if tc.status != http.StatusOK {
+			if result.Valid || len(result.Errors) != 1 || result.Errors[0].Field != "photo" {
+				t.Errorf("Test %d: expected an error for photo, got %s", i, w.Body)
+			}
+			continue
+		}
+		if !result.Valid || len(result.Parts) != 2 {
+			t.Errorf("Test %d: expected 2 valid parts, got %s", i, w.Body)
+			continue
+		}
+		if p := result.Parts[1]; p.Name != "photo" || p.Size != 5 || p.Value != tc.fileValue {
+			t.Errorf("Test %d: expected photo with value %q, got %+v", i, tc.fileValue, p)
+		}
+	}
+}
@@ -0,0 +1,264 @@
+// Copyright 2021 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package form2json
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+// XML shapes the payload into an XML document. In array mode, the root
+// element holds a <part> element per part:
+//
+//	<form>
+//		<part name="title" type="field/text"><value>Hello</value></part>
+//		<part name="photo" type="file/base64"><file_name>a.png</file_name><value>iVBOR...</value></part>
+//	</form>
+//
+// In object mode, the root element holds an element per field, named
+// after the field; fields occurring more than once repeat the element.
+// Fields whose names are not valid XML names use a <field> element with
+// the original name in its "name" attribute. JSON values are rendered as
+// nested elements. File contents are always base64 in <value> elements.
+type XML struct {
+	// The name of the root element. Default: form
+	Root string `json:"root,omitempty"`
+
+	// The properties of parts rendered as attributes rather than child
+	// elements; any of name, type, content_type, file_name, path and
+	// size. Default: name, type
+	Attributes []string `json:"attributes,omitempty"`
+
+	attrs map[string]bool
+}
+
+func (x *XML) provision() error {
+	if x.Root == "" {
+		x.Root = "form"
+	}
+	if !validXMLName(x.Root) {
+		return fmt.Errorf("invalid root element name: %s", x.Root)
+	}
+	if x.Attributes == nil {
+		x.Attributes = []string{"name", "type"}
+	}
+	x.attrs = make(map[string]bool)
+	for _, attr := range x.Attributes {
+		switch attr {
+		case "name", "type", "content_type", "file_name", "path", "size":
+			x.attrs[attr] = true
+		default:
+			return fmt.Errorf("unrecognized part property: %s", attr)
+		}
+	}
+	return nil
+}
+
+// encodeArray writes the converted parts to buf as an XML document
+// in array mode, returning its Content-Type and Content-Type-Class.
+func (x *XML) encodeArray(buf *bytes.Buffer, converted []part) (string, string, error) {
+	enc := x.newEncoder(buf)
+	root := xml.StartElement{Name: xml.Name{Local: x.Root}}
+	err := enc.EncodeToken(root)
+	for i := 0; err == nil && i < len(converted); i++ {
+		err = x.writePart(enc, xml.StartElement{Name: xml.Name{Local: "part"}}, converted[i], true)
+	}
+	return x.finish(enc, buf, root, err, "caddy_post_xml_v1")
+}
+
+// encodeObject writes obj to buf as an XML document in object mode,
+// returning its Content-Type and Content-Type-Class.
+func (x *XML) encodeObject(buf *bytes.Buffer, obj map[string]interface{}) (string, string, error) {
+	enc := x.newEncoder(buf)
+	root := xml.StartElement{Name: xml.Name{Local: x.Root}}
+	err := enc.EncodeToken(root)
+	if err == nil {
+		err = x.writeFields(enc, obj)
+	}
+	return x.finish(enc, buf, root, err, "caddy_post_xml_object_v1")
+}
+
+func (x *XML) newEncoder(buf *bytes.Buffer) *xml.Encoder {
+	buf.WriteString(xml.Header)
+	return xml.NewEncoder(buf)
+}
+
+func (x *XML) finish(enc *xml.Encoder, buf *bytes.Buffer, root xml.StartElement, err error, class string) (string, string, error) {
+	if err == nil {
+		err = enc.EncodeToken(root.End())
+	}
+	if err == nil {
+		err = enc.Flush()
+	}
+	if err != nil {
+		return "", "", caddyhttp.Error(http.StatusInternalServerError, err)
+	}
+	buf.WriteByte('\n')
+	return "application/xml", class, nil
+}
+
+// writeFields writes an element for each field of obj, in name order.
+func (x *XML) writeFields(enc *xml.Encoder, obj map[string]interface{}) error {
+	names := make([]string, 0, len(obj))
+	for name := range obj {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if err := x.writeField(enc, name, obj[name]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeField writes the element(s) for the field name with value v.
+func (x *XML) writeField(enc *xml.Encoder, name string, v interface{}) error {
+	start := xml.StartElement{Name: xml.Name{Local: name}}
+	if !validXMLName(name) {
+		start = xml.StartElement{
+			Name: xml.Name{Local: "field"},
+			Attr: []xml.Attr{{Name: xml.Name{Local: "name"}, Value: name}},
+		}
+	}
+
+	switch val := v.(type) {
+	case []interface{}:
+		for _, elem := range val {
+			if err := x.writeField(enc, name, elem); err != nil {
+				return err
+			}
+		}
+		return nil
+	case json.RawMessage:
+		var decoded interface{}
+		if err := json.Unmarshal(val, &decoded); err != nil {
+			return err
+		}
+		return x.writeField(enc, name, decoded)
+	case part:
+		return x.writePart(enc, start, val, false)
+	}
+
+	if err := enc.EncodeToken(start); err != nil {
+		return err
+	}
+	var err error
+	switch val := v.(type) {
+	case map[string]interface{}:
+		err = x.writeFields(enc, val)
+	case dirTree:
+		err = x.writeFields(enc, val)
+	case nil:
+	default:
+		err = enc.EncodeToken(xml.CharData(xmlText(val)))
+	}
+	if err != nil {
+		return err
+	}
+	return enc.EncodeToken(start.End())
+}
+
+// writePart writes p as the element start. Unless withName is true,
+// the part's name is omitted, since it is given by the element.
+func (x *XML) writePart(enc *xml.Encoder, start xml.StartElement, p part, withName bool) error {
+	props := []struct{ name, value string }{
+		{"type", p.Type},
+		{"content_type", p.ContentType},
+		{"file_name", p.FileName},
+		{"path", p.Path},
+	}
+	if withName {
+		props = append([]struct{ name, value string }{{"name", p.Name}}, props...)
+	}
+	if p.Size > 0 {
+		props = append(props, struct{ name, value string }{"size", strconv.FormatInt(p.Size, 10)})
+	}
+
+	var children []struct{ name, value string }
+	for _, prop := range props {
+		if prop.value == "" {
+			continue
+		}
+		if x.attrs[prop.name] {
+			start.Attr = append(start.Attr, xml.Attr{Name: xml.Name{Local: prop.name}, Value: prop.value})
+		} else {
+			children = append(children, prop)
+		}
+	}
+
+	if err := enc.EncodeToken(start); err != nil {
+		return err
+	}
+	for _, child := range children {
+		if err := enc.EncodeElement(child.value, xml.StartElement{Name: xml.Name{Local: child.name}}); err != nil {
+			return err
+		}
+	}
+	if p.rows != nil {
+		// rows hold their parts, so files within them are written as parts
+		if err := x.writeField(enc, "value", p.rowObjects()); err != nil {
+			return err
+		}
+	} else if p.RawValue != nil {
+		if err := x.writeField(enc, "value", p.RawValue); err != nil {
+			return err
+		}
+	} else if value, err := p.fileValue(); err != nil {
+		return err
+	} else if value != "" {
+		if err := enc.EncodeElement(value, xml.StartElement{Name: xml.Name{Local: "value"}}); err != nil {
+			return err
+		}
+	}
+	return enc.EncodeToken(start.End())
+}
+
+// xmlText returns the text of a scalar JSON value.
+func xmlText(v interface{}) string {
+	switch val := v.(type) {
+	case string:
+		return val
+	case float64:
+		return strconv.FormatFloat(val, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(val)
+	}
+	return fmt.Sprint(v)
+}
+
+// validXMLName returns true if name can be used as an element name as-is.
+// It is stricter than the XML spec, allowing only ASCII names.
+func validXMLName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for i, c := range name {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c == '_':
+		case i > 0 && (c >= '0' && c <= '9' || c == '-' || c == '.'):
+		default:
+			return false
+		}
+	}
+	return len(name) < 3 || (name[:3] != "xml" && name[:3] != "XML")
+}
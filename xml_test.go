@@ -0,0 +1,137 @@
+// Copyright 2021 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package form2json
+
+import (
+	"encoding/xml"
+	"testing"
+)
+
+func TestValidXMLName(t *testing.T) {
+	for i, tc := range []struct {
+		name     string
+		expected bool
+	}{
+		{name: "title", expected: true},
+		{name: "_id", expected: true},
+		{name: "first-name.2", expected: true},
+		{name: "xm", expected: true},
+		{name: ""},
+		{name: "2nd"},
+		{name: "-x"},
+		{name: "a b"},
+		{name: "a[]"},
+		{name: "naïve"},
+		{name: "xmlns"},
+		{name: "XMLData"},
+	} {
+		if actual := validXMLName(tc.name); actual != tc.expected {
+			t.Errorf("Test %d (%q): expected %t, got %t", i, tc.name, tc.expected, actual)
+		}
+	}
+}
+
+func TestXMLProvision(t *testing.T) {
+	for i, tc := range []struct {
+		x         XML
+		expectErr bool
+	}{
+		{x: XML{}},
+		{x: XML{Root: "submission", Attributes: []string{"name", "size"}}},
+		{x: XML{Attributes: []string{}}},
+		{x: XML{Root: "1form"}, expectErr: true},
+		{x: XML{Attributes: []string{"value"}}, expectErr: true},
+	} {
+		err := tc.x.provision()
+		if tc.expectErr != (err != nil) {
+			t.Errorf("Test %d: expected error %t, got %v", i, tc.expectErr, err)
+		}
+	}
+}
+
+func TestXML(t *testing.T) {
+	fields := []testField{
+		{name: "title", value: "Fish & <Chips>"},
+		{name: "tags", value: "a"},
+		{name: "tags", value: "b"},
+		{name: "2nd", value: "x"},
+		{name: "meta", value: `{"n":1.5,"ok":true,"none":null,"list":["x"]}`, contentType: "application/json"},
+		{name: "photo", value: "img", fileName: "a.png", contentType: "image/png"},
+	}
+	for i, tc := range []struct {
+		mode     string
+		x        XML
+		expected string
+	}{
+		{
+			expected: `<form>` +
+				`<part name="title" type="field/text"><value>Fish &amp; &lt;Chips&gt;</value></part>` +
+				`<part name="tags" type="field/text"><value>a</value></part>` +
+				`<part name="tags" type="field/text"><value>b</value></part>` +
+				`<part name="2nd" type="field/text"><value>x</value></part>` +
+				`<part name="meta" type="field/json"><content_type>application/json</content_type>` +
+				`<value><list>x</list><n>1.5</n><none></none><ok>true</ok></value></part>` +
+				`<part name="photo" type="file/base64"><content_type>image/png</content_type><file_name>a.png</file_name>` +
+				`<size>3</size><value>aW1n</value></part>` +
+				`</form>`,
+		},
+		{
+			x: XML{Root: "upload", Attributes: []string{"name", "content_type", "size"}},
+			expected: `<upload>` +
+				`<part name="title"><type>field/text</type><value>Fish &amp; &lt;Chips&gt;</value></part>` +
+				`<part name="tags"><type>field/text</type><value>a</value></part>` +
+				`<part name="tags"><type>field/text</type><value>b</value></part>` +
+				`<part name="2nd"><type>field/text</type><value>x</value></part>` +
+				`<part name="meta" content_type="application/json"><type>field/json</type>` +
+				`<value><list>x</list><n>1.5</n><none></none><ok>true</ok></value></part>` +
+				`<part name="photo" content_type="image/png" size="3"><type>file/base64</type><file_name>a.png</file_name>` +
+				`<value>aW1n</value></part>` +
+				`</upload>`,
+		},
+		{
+			mode: modeObject,
+			expected: `<form>` +
+				`<field name="2nd">x</field>` +
+				`<meta><list>x</list><n>1.5</n><none></none><ok>true</ok></meta>` +
+				`<photo type="file/base64"><content_type>image/png</content_type><file_name>a.png</file_name>` +
+				`<size>3</size><value>aW1n</value></photo>` +
+				`<tags>a</tags><tags>b</tags>` +
+				`<title>Fish &amp; &lt;Chips&gt;</title>` +
+				`</form>`,
+		},
+	} {
+		h := newTestHandler()
+		h.Mode = tc.mode
+		h.EmbedJSON = true
+		h.Encoder = encoderXML
+		x := tc.x
+		if err := x.provision(); err != nil {
+			t.Fatal(err)
+		}
+		h.XML = &x
+		_, next, err := serveTest(t, h, newFormRequest(t, fields...))
+		if err != nil {
+			t.Errorf("Test %d: unexpected error: %v", i, err)
+			continue
+		}
+		if actual := next.req.Header.Get("Content-Type"); actual != "application/xml" {
+			t.Errorf("Test %d: expected content type application/xml, got %s", i, actual)
+		}
+		expected := xml.Header + tc.expected + "\n"
+		if actual := string(next.body); actual != expected {
+			t.Errorf("Test %d: expected:\n%s\ngot:\n%s", i, expected, actual)
+		}
+	}
+}